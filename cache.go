@@ -0,0 +1,191 @@
+package main
+
+import (
+	"container/list"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ChunkCache is a persistent on disk cache of chunk contents, keyed by
+// message id and the edited timestamp of the message.
+// Since an edit always changes the timestamp a stale entry can never be hit,
+// they simply age out of the lru.
+// A nil *ChunkCache is valid and caches nothing.
+type ChunkCache struct {
+	sync.Mutex
+
+	Dir      string
+	MaxBytes int64
+
+	size  int64
+	order *list.List // Front is most recently used
+	items map[string]*list.Element
+}
+
+type chunkCacheEntry struct {
+	key  string
+	size int64
+}
+
+func NewChunkCache(dir string, maxBytes int64) (*ChunkCache, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &ChunkCache{
+		Dir:      dir,
+		MaxBytes: maxBytes,
+		order:    list.New(),
+		items:    make(map[string]*list.Element),
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	// Oldest first so the most recently used ends up in front
+	sort.Sort(byModTime(files))
+	for _, file := range files {
+		if file.IsDir() || strings.HasPrefix(file.Name(), ".tmp") {
+			continue
+		}
+		c.items[file.Name()] = c.order.PushFront(&chunkCacheEntry{key: file.Name(), size: file.Size()})
+		c.size += file.Size()
+	}
+	c.evict()
+
+	log.Printf("Loaded chunk cache with %d entries (%d bytes)", len(c.items), c.size)
+	return c, nil
+}
+
+func chunkCacheKey(id, edited string) string {
+	stamp := strings.Map(func(r rune) rune {
+		if (r >= '0' && r <= '9') || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') {
+			return r
+		}
+		return -1
+	}, edited)
+	return id + "_" + stamp
+}
+
+// Get returns the cached contents of the chunk, if present
+func (c *ChunkCache) Get(id, edited string) ([]byte, bool) {
+	if c == nil {
+		return nil, false
+	}
+	key := chunkCacheKey(id, edited)
+
+	c.Lock()
+	elem, ok := c.items[key]
+	if ok {
+		c.order.MoveToFront(elem)
+	}
+	c.Unlock()
+	if !ok {
+		return nil, false
+	}
+
+	path := filepath.Join(c.Dir, key)
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		log.Println("Failed reading cached chunk", err)
+		c.remove(key)
+		return nil, false
+	}
+
+	// Keep the lru order across restarts
+	now := time.Now()
+	os.Chtimes(path, now, now)
+	return data, true
+}
+
+// Put stores the contents of a chunk, evicting the least recently used chunks if needed
+func (c *ChunkCache) Put(id, edited string, data []byte) {
+	if c == nil {
+		return
+	}
+	key := chunkCacheKey(id, edited)
+
+	// Write to a temporary file first so concurrent puts and readers never see a partial chunk
+	tmp, err := ioutil.TempFile(c.Dir, ".tmp-"+key)
+	if err != nil {
+		log.Println("Failed writing cached chunk", err)
+		return
+	}
+	_, err = tmp.Write(data)
+	tmp.Close()
+	if err == nil {
+		err = os.Rename(tmp.Name(), filepath.Join(c.Dir, key))
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		log.Println("Failed writing cached chunk", err)
+		return
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	if elem, ok := c.items[key]; ok {
+		entry := elem.Value.(*chunkCacheEntry)
+		c.size -= entry.size
+		entry.size = int64(len(data))
+		c.order.MoveToFront(elem)
+	} else {
+		c.items[key] = c.order.PushFront(&chunkCacheEntry{key: key, size: int64(len(data))})
+	}
+	c.size += int64(len(data))
+	c.evict()
+}
+
+// RemoveMessage drops every cached version of the message
+func (c *ChunkCache) RemoveMessage(id string) {
+	if c == nil {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	for key := range c.items {
+		if strings.HasPrefix(key, id+"_") {
+			c.removeLocked(key)
+		}
+	}
+}
+
+func (c *ChunkCache) remove(key string) {
+	c.Lock()
+	defer c.Unlock()
+	c.removeLocked(key)
+}
+
+func (c *ChunkCache) removeLocked(key string) {
+	elem, ok := c.items[key]
+	if !ok {
+		return
+	}
+	entry := elem.Value.(*chunkCacheEntry)
+	c.order.Remove(elem)
+	delete(c.items, key)
+	c.size -= entry.size
+	os.Remove(filepath.Join(c.Dir, key))
+}
+
+// Caller must hold the lock
+func (c *ChunkCache) evict() {
+	for c.size > c.MaxBytes && c.order.Len() > 0 {
+		c.removeLocked(c.order.Back().Value.(*chunkCacheEntry).key)
+	}
+}
+
+type byModTime []os.FileInfo
+
+func (b byModTime) Len() int           { return len(b) }
+func (b byModTime) Less(i, j int) bool { return b[i].ModTime().Before(b[j].ModTime()) }
+func (b byModTime) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
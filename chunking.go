@@ -0,0 +1,120 @@
+package main
+
+// Content defined chunking. With fixed size chunks a byte inserted at the start of a file moves
+// everything after it to another chunk, so every message is written again. With -chunking cdc
+// files are cut where a rolling hash of the contents (FastCDC's gear hash) says so instead, an
+// edit only changes the chunks around it and the rest are found in the chunk index
+//
+// The cuts are made in the decoded data and every chunk is encoded on its own, base64 would
+// shift everything after an insert as well. Files written like that have CDC set
+
+const (
+	cdcMin = 512
+	cdcAvg = 1024
+	cdcMax = BYTES_PER_MSG / 4 * 3 // The largest chunk that fits in a message once encoded
+
+	// Cuts are harder to hit before the average size and easier after, which keeps the sizes
+	// close to the average
+	cdcMaskSmall = uint64(1<<11-1) << 53
+	cdcMaskLarge = uint64(1<<9-1) << 55
+)
+
+// Random numbers for the gear hash, generated from a fixed seed since the cuts have to be the
+// same everywhere for chunks to be shared
+var cdcGear [256]uint64
+
+func init() {
+	// splitmix64
+	x := uint64(0x9e3779b97f4a7c15)
+	for i := range cdcGear {
+		x += 0x9e3779b97f4a7c15
+		z := x
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		cdcGear[i] = z ^ (z >> 31)
+	}
+}
+
+// Returns the length of the chunk at the start of data
+func cdcCut(data []byte) int {
+	n := len(data)
+	if n <= cdcMin {
+		return n
+	}
+	if n > cdcMax {
+		n = cdcMax
+	}
+	normal := cdcAvg
+	if normal > n {
+		normal = n
+	}
+
+	var fp uint64
+	i := cdcMin
+	for ; i < normal; i++ {
+		fp = fp<<1 + cdcGear[data[i]]
+		if fp&cdcMaskSmall == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		fp = fp<<1 + cdcGear[data[i]]
+		if fp&cdcMaskLarge == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
+
+// Cuts data into content defined chunks, there's always at least one
+func cdcSplit(data []byte) [][]byte {
+	pieces := make([][]byte, 0, len(data)/cdcAvg+1)
+	for len(data) > 0 || len(pieces) == 0 {
+		cut := cdcCut(data)
+		pieces = append(pieces, data[:cut])
+		data = data[cut:]
+	}
+	return pieces
+}
+
+// Cuts the data of the file into the parts stored in its chunks. Returns whether they're
+// content defined
+func (f *FileDesc) dataParts() ([][]byte, bool, error) {
+	if *flagChunking != "cdc" {
+		if f.Cache == nil && f.tail != nil {
+			// Only the end is loaded, the chunks before it are kept as they are since
+			// f.flushed covers them
+			return append(make([][]byte, f.tailStart), splitParts(f.tail)...), false, nil
+		}
+		return splitParts(f.Cache), false, nil
+	}
+
+	decoded, err := f.decodedData()
+	if err != nil {
+		return nil, false, err
+	}
+	pieces := cdcSplit(decoded)
+	parts := make([][]byte, len(pieces))
+	for i, piece := range pieces {
+		parts[i] = make([]byte, fileDataEncoder.EncodedLen(len(piece)))
+		fileDataEncoder.Encode(parts[i], piece)
+	}
+	return parts, true, nil
+}
+
+// Puts content defined chunks back together, they're encoded one by one
+func joinCDC(parts [][]byte) ([]byte, error) {
+	decoded := make([]byte, 0)
+	for _, part := range parts {
+		piece := make([]byte, fileDataEncoder.DecodedLen(len(part)))
+		n, err := fileDataEncoder.Decode(piece, part)
+		if err != nil {
+			return nil, err
+		}
+		decoded = append(decoded, piece[:n]...)
+	}
+
+	encoded := make([]byte, fileDataEncoder.EncodedLen(len(decoded)))
+	fileDataEncoder.Encode(encoded, decoded)
+	return encoded, nil
+}
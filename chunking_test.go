@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func randomData(seed int64, n int) []byte {
+	data := make([]byte, n)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+// A byte inserted in the middle only changes the chunks around it
+func TestCDCInsertKeepsChunks(t *testing.T) {
+	data := randomData(1, 64<<10)
+	edited := append(append(append([]byte(nil), data[:len(data)/2]...), 'x'), data[len(data)/2:]...)
+
+	before := make(map[string]bool)
+	for _, piece := range cdcSplit(data) {
+		before[chunkHash(piece)] = true
+	}
+	pieces := cdcSplit(edited)
+	changed := 0
+	for _, piece := range pieces {
+		if len(piece) > cdcMax {
+			t.Fatal("chunk of", len(piece), "bytes is over", cdcMax)
+		}
+		if !before[chunkHash(piece)] {
+			changed++
+		}
+	}
+	if changed > 2 {
+		t.Errorf("%d of %d chunks changed", changed, len(pieces))
+	}
+	if !bytes.Equal(bytes.Join(pieces, nil), edited) {
+		t.Error("chunks don't add up to the data")
+	}
+}
+
+// Files written with -chunking cdc read back, and a copy with a byte inserted sends only the
+// chunks around it
+func TestCDCFilesReadBack(t *testing.T) {
+	fs, root, api := newTestFS(t)
+	*flagChunking = "cdc"
+	defer func() { *flagChunking = "fixed" }()
+
+	data := randomData(2, 32<<10)
+	file := writeFile(t, root, "a", data)
+	if !file.desc.CDC {
+		t.Fatal("file wasn't written with cdc")
+	}
+
+	sent := api.callCount("send") + api.callCount("edit")
+	writeFile(t, root, "empty", nil)
+	overhead := api.callCount("send") + api.callCount("edit") - sent
+
+	sent = api.callCount("send") + api.callCount("edit")
+	edited := append(append(append([]byte(nil), data[:1000]...), 'x'), data[1000:]...)
+	copied := writeFile(t, root, "b", edited)
+	// On top of creating a file, the chunks around the insert and the records of an inode that
+	// lists this many chunks
+	if n := api.callCount("send") + api.callCount("edit") - sent - overhead; n > 5 {
+		t.Errorf("copy with a byte inserted made %d requests for %d chunks", n, len(copied.desc.Chunks))
+	}
+
+	for _, f := range []struct {
+		node *Node
+		want []byte
+	}{{file, data}, {copied, edited}} {
+		read, code := readFile(f.node)
+		if code != 0 || !bytes.Equal(read, f.want) {
+			t.Error("read", code, len(read), "bytes, want", len(f.want))
+		}
+		stored, err := fs.loadInode(f.node.ino)
+		if err != nil {
+			t.Fatal("loading inode", err)
+		}
+		decoded, err := stored.decodedData()
+		if err != nil || !bytes.Equal(decoded, f.want) {
+			t.Error("stored data differs", err)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"sort"
+)
+
+// Deduplication. Full chunks of file data are addressed by the hash of their contents, a chunk
+// that's stored already refers to the existing message instead of sending it again. The chunk
+// index maps hashes to messages and counts the chunks referring to each, a message is only
+// deleted along with the last reference. Messages are never edited once they're in the index
+//
+// The index is kept in memory and stored in the index messages listed in the superblock,
+// written along with the usage counts. If the filesystem wasn't unmounted cleanly the counts
+// can't be trusted, they're counted again from the inodes on the next mount
+
+type indexEntry struct {
+	Hash   string `json:"hash"`
+	ID     string `json:"id"`
+	Edited string `json:"edited,omitempty"`
+	Refs   int    `json:"refs"`
+}
+
+func chunkHash(part []byte) string {
+	sum := sha256.Sum256(part)
+	return hex.EncodeToString(sum[:16])
+}
+
+// Replaces the index with entries, which are by message id
+func (fs *DiscordFS) setIndex(entries map[string]*indexEntry) {
+	fs.indexLock.Lock()
+	defer fs.indexLock.Unlock()
+	fs.refs = entries
+	fs.index = make(map[string]*indexEntry)
+	for _, entry := range entries {
+		if _, ok := fs.index[entry.Hash]; !ok {
+			fs.index[entry.Hash] = entry
+		}
+	}
+}
+
+// Reads the index from the messages holding it
+func (fs *DiscordFS) loadIndex(chunks []*Chunk) (map[string]*indexEntry, error) {
+	var list []*indexEntry
+	err := fs.loadListed(chunks, &list)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make(map[string]*indexEntry)
+	for _, entry := range list {
+		entries[entry.ID] = entry
+	}
+	return entries, nil
+}
+
+// Writes the index to the messages in old, returns the messages now holding it
+func (fs *DiscordFS) saveIndex(old []*Chunk) ([]*Chunk, error) {
+	fs.indexLock.Lock()
+	list := make([]*indexEntry, 0, len(fs.refs))
+	for _, entry := range fs.refs {
+		copied := *entry
+		list = append(list, &copied)
+	}
+	fs.indexDirty = false
+	fs.indexLock.Unlock()
+
+	// Sorted so the parts that didn't change don't need editing
+	sort.Sort(byMessageID(list))
+	return fs.saveListed(list, len(list) == 0, old)
+}
+
+type byMessageID []*indexEntry
+
+func (b byMessageID) Len() int           { return len(b) }
+func (b byMessageID) Less(i, j int) bool { return b[i].ID < b[j].ID }
+func (b byMessageID) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+
+// Writes the parts of a file as chunks, reusing the messages of parts that are stored already
+// and leaving holes for parts of zeros. Also returns the chunks in old that aren't used anymore,
+// the stored inode still points at them so they can only be released after it's written
+func (fs *DiscordFS) writeDedup(channel string, parts [][]byte, old []*Chunk) ([]*Chunk, []*Chunk, error) {
+	written := make([]*Chunk, 0, len(parts))
+	kept := make(map[*Chunk]bool)
+	for i, part := range parts {
+		if isZeroPart(part) {
+			written = append(written, &Chunk{Hole: len(part)})
+			continue
+		}
+
+		hash := chunkHash(part)
+		if i < len(old) && (old[i].Hash == hash || old[i].Hash == "" && fs.cachedEqual(old[i], part)) {
+			// Unchanged, chunks from before the index stay as they are
+			written = append(written, old[i])
+			kept[old[i]] = true
+			continue
+		}
+
+		chunk, err := fs.storeChunk(channel, hash, part)
+		if err != nil {
+			for _, chunk := range written {
+				if !kept[chunk] {
+					fs.releaseChunk(channel, chunk)
+				}
+			}
+			return nil, nil, err
+		}
+		written = append(written, chunk)
+	}
+
+	dropped := make([]*Chunk, 0)
+	for _, chunk := range old {
+		if !kept[chunk] {
+			dropped = append(dropped, chunk)
+		}
+	}
+	return written, dropped, nil
+}
+
+func (fs *DiscordFS) cachedEqual(chunk *Chunk, part []byte) bool {
+	cached, ok := fs.chunks.Get(chunk.ID, chunk.Edited)
+	return ok && bytes.Equal(cached, part)
+}
+
+// Returns a chunk holding part, a new reference to the message if it's in the index already
+func (fs *DiscordFS) storeChunk(channel, hash string, part []byte) (*Chunk, error) {
+	fs.indexLock.Lock()
+	if entry, ok := fs.index[hash]; ok {
+		entry.Refs++
+		fs.indexDirty = true
+		fs.indexLock.Unlock()
+		return &Chunk{ID: entry.ID, Edited: entry.Edited, Hash: hash}, nil
+	}
+	fs.indexLock.Unlock()
+
+	msg, err := fs.allocMessage(channel, "f"+string(part))
+	if err != nil {
+		return nil, err
+	}
+	fs.chunks.Put(msg.ID, string(msg.EditedTimestamp), part)
+
+	// Someone else may have sent the same part in the meantime, the hash keeps pointing at theirs
+	entry := &indexEntry{Hash: hash, ID: msg.ID, Edited: string(msg.EditedTimestamp), Refs: 1}
+	fs.indexLock.Lock()
+	fs.refs[msg.ID] = entry
+	if _, ok := fs.index[hash]; !ok {
+		fs.index[hash] = entry
+	}
+	fs.indexDirty = true
+	fs.indexLock.Unlock()
+	return &Chunk{ID: msg.ID, Edited: string(msg.EditedTimestamp), Hash: hash}, nil
+}
+
+// Drops a reference to the message of a chunk, it's freed along with the last one. Chunks
+// from before the index are the only reference to their message
+func (fs *DiscordFS) releaseChunk(channel string, chunk *Chunk) {
+	if chunk.Hole > 0 {
+		return
+	}
+
+	fs.indexLock.Lock()
+	entry, ok := fs.refs[chunk.ID]
+	if ok {
+		entry.Refs--
+		fs.indexDirty = true
+		if entry.Refs > 0 {
+			fs.indexLock.Unlock()
+			return
+		}
+		delete(fs.refs, chunk.ID)
+		if fs.index[entry.Hash] == entry {
+			delete(fs.index, entry.Hash)
+		}
+	}
+	fs.indexLock.Unlock()
+
+	if !ok && chunk.Hash != "" {
+		// Can't tell who else uses it, leaking it is the safe side
+		log.Println("Chunk", chunk.ID, "is missing from the index, not freeing it")
+		return
+	}
+
+	err := fs.freeMessage(channel, chunk.ID)
+	if err != nil {
+		log.Println("Failed freeing message", chunk.ID, err)
+	}
+}
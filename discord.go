@@ -3,31 +3,274 @@ package main
 import (
 	"github.com/jonas747/discordgo"
 	"log"
+	"strings"
+	"syscall"
 )
 
-func (fs *DiscordFS) OnMessageCreate(s *discordgo.Session, r *discordgo.MessageCreate) {
-	if fs.Guild == r.ChannelID {
-		fs.InvalidateCache()
-	}
+// Max amount of own events we wait for an echo of, if the gateway drops them
+// we start over rather than grow forever
+const maxPendingOwnEvents = 10000
+
+// Own events are recorded before the request is made, the echo can arrive before the response.
+// We don't know the edited timestamp by then, edits are matched on their content instead
+const deletedEvent = "deleted"
+
+// The requests we make, the session or a fake in tests
+type discordAPI interface {
+	ChannelMessageSend(channelID, content string) (*discordgo.Message, error)
+	ChannelMessageEdit(channelID, messageID, content string) (*discordgo.Message, error)
+	ChannelMessageDelete(channelID, messageID string) error
+	ChannelMessage(channelID, messageID string) (*discordgo.Message, error)
+	ChannelMessages(channelID string, limit int, beforeID, afterID string) ([]*discordgo.Message, error)
+	ChannelEdit(channelID, name, topic string, position, bitrate, userLimit int) (*discordgo.Channel, error)
 }
+
+// New messages are never part of an existing file, changes to a file always show up
+// as an edit (of the data, the inode or the directory), so creates need no handling
+
 func (fs *DiscordFS) OnMessageRemove(s *discordgo.Session, r *discordgo.MessageDelete) {
-	if fs.Guild == r.ChannelID {
-		fs.InvalidateCache()
+	if fs.Guild == r.ChannelID && !fs.isOwnEvent(r.ID, deletedEvent) {
+		go fs.InvalidateMessage(r.ID)
 	}
 }
+
 func (fs *DiscordFS) OnMessageEdit(s *discordgo.Session, e *discordgo.MessageUpdate) {
-	if fs.Guild == e.ChannelID {
-		fs.InvalidateCache()
+	if fs.Guild == e.ChannelID && !fs.isOwnEvent(e.ID, editEvent(e.Content)) {
+		go fs.InvalidateMessage(e.ID)
+	}
+}
+
+func editEvent(content string) string {
+	return chunkHash([]byte(strings.TrimSpace(content)))
+}
+
+// Drops the chunk and the in memory data of the inode that owns the message
+func (fs *DiscordFS) InvalidateMessage(id string) {
+	fs.chunks.RemoveMessage(id)
+
+	fs.ownLock.Lock()
+	owner, ok := fs.owners[id]
+	delete(fs.owners, id)
+	fs.ownLock.Unlock()
+	if !ok {
+		return
+	}
+
+	node := fs.getNode(owner.Ino)
+	if node == nil {
+		return
+	}
+
+	log.Println("Invalidating", owner.Ino, "message", id, "changed")
+	switch owner.Chunk {
+	case ownerDirData, ownerInode:
+		// The entries are only edited in place by older versions, the inode points at
+		// the messages holding them
+		fs.refreshInode(node)
+		return
+	}
+
+	node.lock.Lock()
+	if !node.desc.Dirty {
+		node.desc.Cache = nil
+		node.desc.tail = nil
+	}
+	cdc := node.desc.CDC
+	node.lock.Unlock()
+
+	if cdc {
+		// Content defined chunks don't say where they are in the file
+		fs.notifyFile(node, 0, 0)
+		return
+	}
+
+	// Chunks are cut from the base64 encoded data, 4 characters make up 3 bytes
+	off := int64(owner.Chunk*BYTES_PER_MSG/4) * 3
+	fs.notifyFile(node, off, int64(BYTES_PER_MSG/4+2)*3)
+}
+
+// Fetches the inode again, for directories the entries are compared as well
+func (fs *DiscordFS) refreshInode(node *Node) {
+	ino := node.ino
+
+	// Loaded under the lock, or a write in between would be undone by what was stored before it
+	node.lock.Lock()
+	desc, err := fs.loadInode(ino)
+	if err != nil {
+		node.lock.Unlock()
+		log.Println("Failed getting changed inode", ino, err)
+		return
+	}
+
+	if !node.desc.Dirty {
+		node.desc.refresh(desc)
+	}
+	isDir := node.desc.IsDir
+	node.lock.Unlock()
+
+	if isDir {
+		// The entries may have moved along with the inode
+		fs.refreshDir(node)
+		return
+	}
+	fs.notifyFile(node, 0, 0)
+}
+
+// Fetches the entries of a directory again and compares them against what we had,
+// the kernel is told to drop the dentries of names that changed
+func (fs *DiscordFS) refreshDir(node *Node) {
+	node.lock.Lock()
+
+	// Everything the kernel could know about, from the old data and the nodes it looked up
+	oldEntries := make(map[string]uint64)
+	if node.desc.Cache != nil {
+		entries, err := node.desc.GetDirEntries()
+		if err == nil {
+			for _, entry := range entries {
+				oldEntries[entry.Name] = entry.Ino
+			}
+		}
+	}
+	for name, child := range node.Children() {
+		if childNode, ok := child.Operations().(*Node); ok {
+			oldEntries[name] = childNode.ino
+		}
+	}
+
+	node.desc.Cache = nil
+	newEntries, err := node.desc.GetDirEntries()
+	if err != nil {
+		node.lock.Unlock()
+		log.Println("Failed getting changed directory", err)
+		fs.notifyFile(node, 0, 0)
+		return
+	}
+
+	changed := make([]string, 0)
+	for _, entry := range newEntries {
+		oldIno, ok := oldEntries[entry.Name]
+		delete(oldEntries, entry.Name)
+		if ok && oldIno == entry.Ino {
+			continue
+		}
+
+		// The name points at another inode now
+		changed = append(changed, entry.Name)
+		node.RmChild(entry.Name)
+	}
+	for name := range oldEntries {
+		changed = append(changed, name)
+		node.RmChild(name)
+	}
+	node.lock.Unlock()
+
+	// Never notify while holding the lock, the kernel may be waiting on us
+	if !fs.mounted() {
+		return
+	}
+	for _, name := range changed {
+		node.NotifyEntry(name)
+	}
+	fs.notifyFile(node, 0, 0)
+}
+
+// Tells the kernel to drop its cached pages and attributes of a range in a file
+func (fs *DiscordFS) notifyFile(node *Node, off, length int64) {
+	if !fs.mounted() {
+		return
+	}
+	code := node.NotifyContent(off, length)
+	if code != 0 && code != syscall.ENOENT {
+		log.Println("Failed notifying kernel of change in", node.getPath(), code)
+	}
+}
+
+// The kernel can only be notified once the server is up
+func (fs *DiscordFS) mounted() bool {
+	fs.ownLock.Lock()
+	defer fs.ownLock.Unlock()
+	return fs.server != nil
+}
+
+type messageOwner struct {
+	Ino   uint64
+	Chunk int // Index of the chunk in the file, or ownerDirData or ownerInode
+}
+
+// Registers the message as part of the inode
+func (fs *DiscordFS) setOwner(id string, ino uint64, chunk int) {
+	fs.ownLock.Lock()
+	fs.owners[id] = &messageOwner{Ino: ino, Chunk: chunk}
+	fs.ownLock.Unlock()
+}
+
+// Records an event we're about to cause, the same edit can be pending more than once
+func (fs *DiscordFS) addOwnEvent(id, event string) {
+	fs.ownLock.Lock()
+	if len(fs.ownEvents) >= maxPendingOwnEvents {
+		fs.ownEvents = make(map[string]int)
+	}
+	fs.ownEvents[chunkCacheKey(id, event)]++
+	fs.ownLock.Unlock()
+}
+
+// Returns true if the event was caused by this session, each event is only reported once
+func (fs *DiscordFS) isOwnEvent(id, event string) bool {
+	key := chunkCacheKey(id, event)
+
+	fs.ownLock.Lock()
+	defer fs.ownLock.Unlock()
+	if fs.ownEvents[key] < 1 {
+		return false
+	}
+	fs.ownEvents[key]--
+	if fs.ownEvents[key] == 0 {
+		delete(fs.ownEvents, key)
+	}
+	return true
+}
+
+// Sends a message, there's no echo to ignore
+func (fs *DiscordFS) sendMessage(channel, content string) (*discordgo.Message, error) {
+	msg, err := fs.api.ChannelMessageSend(channel, content)
+	if err != nil {
+		return nil, err
+	}
+	fs.addUsage(0, 0, 1)
+	return msg, nil
+}
+
+// Edits a message and records it so we don't react to our own echo
+func (fs *DiscordFS) editMessage(channel, id, content string) (*discordgo.Message, error) {
+	event := editEvent(content)
+	fs.addOwnEvent(id, event)
+	msg, err := fs.api.ChannelMessageEdit(channel, id, content)
+	if err != nil {
+		// There won't be an echo
+		fs.isOwnEvent(id, event)
+		return nil, err
 	}
+	return msg, nil
 }
 
-func (fs *DiscordFS) OnChannelEdit(s *discordgo.Session, c *discordgo.ChannelUpdate) {
-	if fs.Guild == c.Channel.ID {
-		fs.InvalidateCache()
+// Deletes a message and records it so we don't react to our own echo
+func (fs *DiscordFS) deleteMessage(channel, id string) error {
+	fs.addOwnEvent(id, deletedEvent)
+	fs.chunks.RemoveMessage(id)
+	fs.ownLock.Lock()
+	delete(fs.owners, id)
+	fs.ownLock.Unlock()
+	err := fs.api.ChannelMessageDelete(channel, id)
+	if err != nil {
+		fs.isOwnEvent(id, deletedEvent)
+		return err
 	}
+	fs.addUsage(0, 0, -1)
+	return nil
 }
 
-func (fs *DiscordFS) InvalidateCache() {
-	log.Println("!PURGING CACHE!")
-	fs.cache.Purge()
+// Sets the channel topic, which points at the root inode
+func (fs *DiscordFS) setTopic(name, topic string) error {
+	_, err := fs.api.ChannelEdit(fs.Guild, name, topic, 0, 0, 8000)
+	return err
 }
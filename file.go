@@ -4,38 +4,111 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"errors"
-	"github.com/hanwen/go-fuse/fuse"
-	"github.com/hanwen/go-fuse/fuse/nodefs"
+	"github.com/hanwen/go-fuse/v2/fuse"
 	"log"
-	"math"
 	"strings"
+	"syscall"
 	"time"
 )
 
 const (
 	BYTES_PER_MSG = 1999
+	INLINE_MAX    = 512 // Files up to this size can be kept in the inode
+
+	// Discord snowflakes count milliseconds from the start of 2015
+	DISCORD_EPOCH = 1420070400000
 )
 
 var fileDataEncoder = base64.StdEncoding
 
+// FileDesc is the inode as stored in the inode table, along with the
+// in memory data shared by everyone that has the file open
 type FileDesc struct {
-	nodefs.File `json:"-"`
-	FS          *DiscordFS `json:"-"`
+	FS *DiscordFS `json:"-"`
 
-	Name   string `json:"name,omitempty"`
-	Path   string `json:"path"`
 	IsRoot bool   `json:"is_root,omitemptyt"`
 	IsDir  bool   `json:"is_dir,omitempty"`
+	IsLink bool   `json:"is_link,omitempty"`
+	Ino    uint64 `json:"ino,omitempty"`
 
 	Size int `json:"size"`
 
-	DataCapacity  int    `json:"capacity"` // How many messages is allocated, is alreays >= count
+	// Symlinks have no data messages, the target is stored here
+	Target string `json:"target,omitempty"`
+
+	// Unix nanoseconds, zero means unchanged since the file was created (see BirthTime)
+	Mtime int64 `json:"mtime,omitempty"`
+	Ctime int64 `json:"ctime,omitempty"`
+	Atime int64 `json:"atime,omitempty"`
+
+	// File type and permission bits, zero for files made before modes were stored
+	Mode uint32 `json:"mode,omitempty"`
+	Uid  uint32 `json:"uid,omitempty"`
+	Gid  uint32 `json:"gid,omitempty"`
+	Rdev uint32 `json:"rdev,omitempty"` // Device number of device nodes
+
+	// Number of directory entries pointing at the inode, zero for inodes made before hard links (which have one)
+	Nlink int `json:"nlink,omitempty"`
+
+	// The rename journal and the superblock, only set on the root. See rename.go and superblock.go
+	Journal string      `json:"journal,omitempty"`
+	Super   *Superblock `json:"superblock,omitempty"`
+
+	// Limits and usage of the files below a directory, see quota.go
+	Quota *Quota `json:"quota,omitempty"`
+
+	// Extended attributes, see xattr.go
+	Xattrs     map[string][]byte     `json:"xattrs,omitempty"`
+	XattrBlobs map[string]*XattrBlob `json:"xattr_blobs,omitempty"`
+
+	// How many messages is allocated, is alreays >= count. Inodes from before chunks were tracked
+	// have a run of messages, directories with room to grow into. Chunks are tracked one by one
+	// now and a growing inode takes messages off the free list instead, which is where that room
+	// went, so for inodes written since it's the number of chunks
+	DataCapacity  int    `json:"capacity"`
 	DataStart     string `json:"start_id"`
 	DataChannelID string `json:"channel_id"`
 	DataMsgCount  int    `json:"count"`
 
-	Dirty bool   `json:"-"` // True if the file changed, should be sent again on flush then
-	Cache []byte `json:"-"` // cache
+	// Small files have their data in the inode instead of data messages, encoded like the
+	// chunks. They move to data messages once they grow past INLINE_MAX and stay there
+	Inline     bool   `json:"inline,omitempty"`
+	InlineData string `json:"inline_data,omitempty"`
+
+	// Data messages in order, only tracked for regular files. The edited timestamp
+	// is kept so the chunk cache can be used without asking discord first. With CDC the
+	// chunks are content defined and encoded one by one, see chunking.go
+	Chunks chunkList `json:"chunks,omitempty"`
+	CDC    bool      `json:"cdc,omitempty"`
+
+	Dirty      bool   `json:"-"` // True if the data changed, should be sent again on flush then
+	InodeDirty bool   `json:"-"` // True if the inode changed, should be written to the inode table then
+	Cache      []byte `json:"-"` // cache
+
+	records    []*Chunk // Messages holding the inode if it didn't fit in the handle
+	unlinked   bool     // The last name is gone, the inode is freed once the kernel forgets it
+	storedSize int      // Size as last written to the inode table, for the usage counts
+	flushed    int      // Length of the encoded data known to match the chunks, appends only send what's after it
+	tail       []byte   // Without a cache, the encoded data from chunk tailStart on, what appends load
+	tailStart  int
+	garbage    []*Chunk // Chunks the stored inode may still use, released once it's written
+}
+
+type Chunk struct {
+	ID     string `json:"id"`
+	Edited string `json:"edited,omitempty"`
+
+	// The range of the message holding the chunk and its generation, for chunks in a pack (see pack.go)
+	Gen string `json:"gen,omitempty"`
+	Off int    `json:"off,omitempty"`
+	Len int    `json:"len,omitempty"`
+
+	// Hash of the contents for chunks in the chunk index, see dedup.go
+	Hash string `json:"hash,omitempty"`
+
+	// Characters of zeros for holes, which have no message. See sparse.go
+	Hole   int `json:"hole,omitempty"`
+	Repeat int `json:"repeat,omitempty"` // Only stored, how many more of the same hole follow
 }
 
 var (
@@ -45,34 +118,110 @@ var (
 )
 
 func (f *FileDesc) GetData() ([]byte, error) {
-	// Will add support for this later
-	if f.DataMsgCount > 100 {
-		return nil, ErrFileTooLarge
+	if f.Cache != nil {
+		return f.Cache, nil
 	}
 
-	if f.Cache != nil {
+	if f.Inline {
+		f.Cache = []byte(f.InlineData)
 		return f.Cache, nil
 	}
+	if f.Chunks == nil && f.DataMsgCount > 0 {
+		err := f.loadLegacyChunks()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return f.readChunks()
+}
 
-	msgs, err := f.FS.Session.ChannelMessages(f.DataChannelID, f.DataMsgCount, "", f.DataStart)
+// Inodes created before chunks were tracked only know where their run of messages starts and
+// how many it has, fetches the messages following the start and records them as chunks. The
+// room a directory had to grow into is released once the inode is written
+func (f *FileDesc) loadLegacyChunks() error {
+	if f.capacity() > 100 {
+		return ErrFileTooLarge
+	}
+
+	msgs, err := f.FS.fetchMessages(f.DataChannelID, f.capacity(), f.DataStart)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	if len(msgs) < 1 {
-		return []byte{}, nil
+
+	// Oldest first
+	chunks := make([]*Chunk, 0, len(msgs))
+	for i := len(msgs) - 1; i >= 0; i-- {
+		chunk := &Chunk{ID: msgs[i].ID, Edited: string(msgs[i].EditedTimestamp)}
+		if len(chunks) >= f.DataMsgCount {
+			// Other files may have sent messages in between, only the empty ones are ours
+			if msgs[i].Content == "f" {
+				f.garbage = append(f.garbage, chunk)
+			}
+			continue
+		}
+		chunks = append(chunks, chunk)
+		f.FS.chunks.Put(msgs[i].ID, string(msgs[i].EditedTimestamp), []byte(msgs[i].Content[1:]))
 	}
+	f.Chunks = chunks
+	f.registerChunks()
+
+	if f.IsDir && f.DataStart != inodeMessageID(f.InodeNumber()) {
+		// Moved directories start at a handle of their own
+		start, err := f.FS.fetchMessage(f.DataChannelID, f.DataStart)
+		if err == nil && strings.HasSuffix(start.Content, " Handle") {
+			f.garbage = append(f.garbage, &Chunk{ID: start.ID})
+		}
+	}
+	return nil
+}
+
+// How many messages the run of an inode from before chunks were tracked has, older inodes
+// only have the count
+func (f *FileDesc) capacity() int {
+	if f.DataCapacity < f.DataMsgCount {
+		return f.DataMsgCount
+	}
+	return f.DataCapacity
+}
+
+// Reads the data, chunks not in the chunk cache are fetched one by one
+func (f *FileDesc) readChunks() ([]byte, error) {
+	// After an append the end is in the tail, the chunks there may not have it yet
+	chunks := f.Chunks
+	if f.tail != nil {
+		chunks = chunks[:f.tailStart]
+	}
+
 	data := make([]byte, 0)
-	for i := len(msgs) - 1; i >= 0; i-- {
-		data = append(data, []byte(msgs[i].Content[1:])...)
+	parts := make([][]byte, 0, len(chunks))
+	for _, chunk := range chunks {
+		content, err := f.FS.readChunk(f.DataChannelID, chunk)
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, content...)
+		parts = append(parts, content)
+	}
+	if f.CDC {
+		var err error
+		data, err = joinCDC(parts)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if f.tail != nil {
+		data = append(data, f.tail...)
+		f.tail = nil
+	} else {
+		f.flushed = len(data)
 	}
-	log.Println(string(data))
-	f.Cache = data // cache the mafucka
+	f.Cache = data
 	return data, nil
 }
 
 // Returns file entries in this folder
 // Panics if f is not a folder
-func (f *FileDesc) GetDirEntries() (entries []*FileDesc, err error) {
+func (f *FileDesc) GetDirEntries() (entries []*DirEntry, err error) {
 	if !f.IsDir {
 		panic("Not a directory")
 	}
@@ -81,219 +230,297 @@ func (f *FileDesc) GetDirEntries() (entries []*FileDesc, err error) {
 	if err != nil {
 		return nil, err
 	}
+	if len(data) == 0 {
+		// New directories have no data until there's an entry
+		return make([]*DirEntry, 0), nil
+	}
 
-	err = json.Unmarshal(data, &entries)
+	var raw []json.RawMessage
+	err = json.Unmarshal(data, &raw)
 	if err != nil {
 		return
 	}
 
-	for _, v := range entries {
-		v.FS = f.FS
-	}
-	return
-}
+	legacy := false
+	entries = make([]*DirEntry, 0, len(raw))
+	for _, encoded := range raw {
+		var entry *DirEntry
+		err = json.Unmarshal(encoded, &entry)
+		if err != nil {
+			return nil, err
+		}
 
-func (f *FileDesc) GetChild(path string) (*FileDesc, error) {
-	if !f.IsDir {
-		return nil, ErrNotDir
-	}
-	split := strings.SplitN(path, "/", 2)
-	if split[0] == "" {
-		return f, nil
-	}
+		// Entries from before the inode table hold the whole inode, they have a start_id
+		var probe struct {
+			Start string `json:"start_id"`
+		}
+		json.Unmarshal(encoded, &probe)
+		if probe.Start != "" {
+			var desc *FileDesc
+			err = json.Unmarshal(encoded, &desc)
+			if err != nil {
+				return nil, err
+			}
+			desc.FS = f.FS
+			desc.registerChunks()
 
-	entries, err := f.GetDirEntries()
-	if err != nil {
-		return nil, err
+			entry = newDirEntry(entry.Name, desc)
+			entry.legacy = desc
+			legacy = true
+		}
+		entries = append(entries, entry)
 	}
 
-	for _, entry := range entries {
-		if entry.Name == split[0] {
-			if len(split) < 2 {
-				return entry, nil
-			} else {
-				return entry.GetChild(split[1])
-			}
+	if legacy {
+		err = f.migrateEntries(entries)
+		if err != nil {
+			log.Println("Failed moving directory to the inode table, trying again next time", err)
 		}
 	}
-	return nil, ErrFileNotFound
+	return entries, nil
 }
 
-func (f *FileDesc) AddChild(desc *FileDesc) error {
-	currentEntries, err := f.GetDirEntries()
-	if err != nil {
-		return err
+// Moves the inodes embedded in the entries to the inode table and writes the directory
+// with only the names left
+func (f *FileDesc) migrateEntries(entries []*DirEntry) error {
+	log.Println("Moving entries of", f.InodeNumber(), "to the inode table")
+	for _, entry := range entries {
+		if entry.legacy == nil {
+			continue
+		}
+		err := entry.legacy.WriteInode()
+		if err != nil {
+			return err
+		}
 	}
 
-	currentEntries = append(currentEntries, desc)
-	serialized, err := json.Marshal(currentEntries)
+	serialized, err := json.Marshal(entries)
 	if err != nil {
 		return err
 	}
-
 	f.Cache = serialized
+	if code := f.Flush(); code != fuse.OK {
+		return errors.New("Failed writing directory: " + code.String())
+	}
+	if f.InodeDirty {
+		err = f.WriteInode()
+		if err != nil {
+			return err
+		}
+		f.InodeDirty = false
+	}
+
+	for _, entry := range entries {
+		entry.legacy = nil
+	}
 	return nil
 }
 
-func (f *FileDesc) WriteInode() {
-	if f.IsRoot {
-		err := f.FS.WriteRootDesc(f)
-		if err != nil {
-			log.Println("Error writing root desc", err)
+// Inodes created before the number was stored get it from their current handle
+func (f *FileDesc) InodeNumber() uint64 {
+	if f.Ino == 0 {
+		f.Ino = snowflakeIno(f.DataStart)
+	}
+	return f.Ino
+}
+
+// Lets the gateway handlers know which file the chunks belong to. Packs belong to more than
+// one file, but the ranges in them never change
+func (f *FileDesc) registerChunks() {
+	for i, chunk := range f.Chunks {
+		switch {
+		case f.IsDir:
+			f.FS.setOwner(chunk.ID, f.InodeNumber(), ownerDirData)
+		case chunk.Len == 0 && chunk.Hole == 0:
+			f.FS.setOwner(chunk.ID, f.InodeNumber(), i)
 		}
-		return
 	}
-	parentDesc, err := f.FS.GetFileParent(f.Path)
-	if err != nil {
-		log.Println("Failed retrieving parent", err)
-		return
+}
+
+// Takes over the stored attributes of from, keeping the in memory state that isn't stored
+func (f *FileDesc) refresh(from *FileDesc) {
+	fs := f.FS
+	*f = *from
+	f.FS = fs
+	f.Cache = nil
+	f.Dirty = false
+	f.InodeDirty = false
+}
+
+func (f *FileDesc) GetChild(name string) (*DirEntry, error) {
+	if !f.IsDir {
+		return nil, ErrNotDir
 	}
 
-	entries, err := parentDesc.GetDirEntries()
+	entries, err := f.GetDirEntries()
 	if err != nil {
-		log.Println("Failed retrieveving entries", err)
-		return
+		return nil, err
 	}
 
-	for k, v := range entries {
-		if v.Path == f.Path {
-			entries[k] = f
-			break
+	for _, entry := range entries {
+		if entry.Name == name {
+			return entry, nil
 		}
 	}
+	return nil, ErrFileNotFound
+}
 
-	serialized, err := json.Marshal(entries)
-	if err != nil {
-		log.Println("Failed serializing entries", err)
-		return
+func (f *FileDesc) links() int {
+	if f.Nlink < 1 {
+		return 1
 	}
-	parentDesc.Cache = serialized
-	parentDesc.Flush()
+	return f.Nlink
 }
 
-func (f *FileDesc) UpdatePath(oldPath, newPath string) error {
-	f.Path = strings.Replace(f.Path, oldPath, newPath, 1)
-	if f.IsDir {
-		entries, err := f.GetDirEntries()
-		if err != nil {
-			return err
-		}
-
-		for _, entry := range entries {
-			err := entry.UpdatePath(oldPath, newPath)
-			if err != nil {
-				return err
-			}
-		}
-		serialized, err := json.Marshal(entries)
-		if err != nil {
-			return err
-		}
+func (f *FileDesc) link() {
+	f.Nlink = f.links() + 1
+	f.changed()
+}
 
-		f.Cache = serialized
-		f.Flush()
+// Drops a link, the inode is marked unlinked when it was the last one
+func (f *FileDesc) unlink() {
+	if f.links() <= 1 {
+		f.unlinked = true
+		return
 	}
-
-	return nil
+	f.Nlink = f.links() - 1
+	f.changed()
 }
 
 ///////////////////////////
-// Implement nodefs.File
+// Inode data
 ///////////////////////////
 
-// Called upon registering the filehandle in the inode.
-func (f *FileDesc) SetInode(*nodefs.Inode) { log.Println("SET INODE") }
-
-// The String method is for debug printing.
-func (f *FileDesc) String() string { return f.Name }
-
-// Wrappers around other File implementations, should return
-// the inner file here.
-func (f *FileDesc) InnerFile() nodefs.File { return f }
-
-// Nondirectory filedata is encoded in base64 to be on the safe side
-func (f *FileDesc) Read(dest []byte, off int64) (fuse.ReadResult, fuse.Status) {
-	log.Println("READ", off, len(dest))
+// Returns the decoded contents of the file, loading it if needed
+func (f *FileDesc) decodedData() ([]byte, error) {
 	data, err := f.GetData()
 	if err != nil {
-		return nil, fuse.EBADF
+		return nil, err
 	}
 
 	decoded := make([]byte, fileDataEncoder.DecodedLen(len(data)))
 	n, err := fileDataEncoder.Decode(decoded, data)
 	if err != nil {
-		log.Println("Failed decoding data")
-		return nil, fuse.EBADF
+		return nil, err
 	}
-	decoded = decoded[:n] // Baibai padding
+	return decoded[:n], nil // strip away padding
+}
 
-	if off >= int64(len(decoded)) {
-		return nil, fuse.EINVAL
+// Decodes the bytes in [off, end) of the data, end at most the size. Only the characters they're
+// in are decoded, ranges in a hole are zeros without looking at the chunks
+func (f *FileDesc) decodedRange(off, end int64) ([]byte, error) {
+	for _, h := range f.holes() {
+		if h.start <= off && end <= h.end {
+			return make([]byte, end-off), nil
+		}
 	}
 
-	toRead := int64(len(dest))
-	if toRead+off >= int64(len(decoded)) {
-		toRead = int64(len(decoded)) - off
-		log.Println("Bigger than input")
+	// Every 3 bytes are 4 characters
+	first := off / 3 * 3
+	encoded, err := f.encodedRange(int(first/3*4), int((end+2)/3*4))
+	if err != nil {
+		return nil, err
 	}
-
-	copy(dest, decoded[off:off+toRead])
-	rs := NewReadResult(dest, int(toRead))
-	return rs, fuse.OK
+	decoded := make([]byte, fileDataEncoder.DecodedLen(len(encoded)))
+	n, err := fileDataEncoder.Decode(decoded, encoded)
+	if err != nil {
+		return nil, err
+	}
+	if int64(n) < end-first {
+		return nil, errors.New("Cached data is shorter than the file")
+	}
+	return decoded[off-first : end-first], nil
 }
 
-func (f *FileDesc) Write(data []byte, off int64) (written uint32, code fuse.Status) {
-	log.Println("WRITE", len(data), off)
+// Replaces the contents of the file, they're sent on the next flush
+func (f *FileDesc) setDecodedData(decoded []byte) {
+	encoded := make([]byte, fileDataEncoder.EncodedLen(len(decoded)))
+	fileDataEncoder.Encode(encoded, decoded)
+	f.Cache = encoded
+	f.Size = len(decoded)
+	f.Dirty = true
+	f.flushed = 0
+}
 
-	// We need the cache for this so load up the cache if needed
-	if f.Cache == nil {
-		_, err := f.GetData()
-		if err != nil {
-			log.Println("Failed loading data", err)
-			return 0, fuse.EBADF
-		}
+// Adds data to the end of the file without decoding all of it, only the last few characters
+// of the encoded data can change
+func (f *FileDesc) appendData(data []byte) error {
+	encoded, start, err := f.encodedEnd()
+	if err != nil {
+		return err
 	}
 
-	decoded := make([]byte, fileDataEncoder.DecodedLen(len(f.Cache)))
-	n, err := fileDataEncoder.Decode(decoded, f.Cache)
+	// Every 3 bytes are 4 characters, the bytes after the last full group are encoded again
+	keep := f.Size/3*4 - start
+	if keep < 0 || keep > len(encoded) {
+		return errors.New("Cached data is shorter than the file")
+	}
+	last := make([]byte, 3)
+	n, err := fileDataEncoder.Decode(last, encoded[keep:])
 	if err != nil {
-		log.Println("Failed decoding data", err)
-		return 0, fuse.EBADF
+		return err
 	}
-	decoded = decoded[:n] // strip away padding
+	tail := append(last[:n], data...)
 
-	// encoded := make([]byte, fileDataEncoder.EncodedLen(len(data)))
-	// base64.StdEncoding.Encode(encoded, data)
-
-	// offEncoded := int64(base64.StdEncoding.EncodedLen(int(off)))
+	grown := make([]byte, fileDataEncoder.EncodedLen(len(tail)))
+	fileDataEncoder.Encode(grown, tail)
+	if f.Cache != nil {
+		f.Cache = append(encoded[:keep], grown...)
+	} else {
+		f.tail = append(encoded[:keep], grown...)
+	}
+	f.Size += len(data)
+	f.Dirty = true
+	if f.flushed > start+keep {
+		f.flushed = start + keep
+	}
+	return nil
+}
 
-	if int64(len(data))+off > int64(len(decoded)) {
-		//temp := f.Cache
-		newBuf := make([]byte, off+int64(len(data)))
-		//f.Cache =
-		copy(newBuf, decoded)
-		f.Size = len(newBuf)
-		decoded = newBuf
-		log.Println("Expanded buffer")
-		// Since size changed we need to rewrite the filedesc
-		f.WriteInode()
+// Returns the end of the encoded data an append changes, and where in the data it starts. Files
+// with fixed chunks that aren't loaded only load the chunks from the one with the last full group
+// of characters on, the ones before stay as they are until something reads them
+func (f *FileDesc) encodedEnd() ([]byte, int, error) {
+	if f.Cache != nil {
+		return f.Cache, 0, nil
+	}
+	if f.tail != nil {
+		return f.tail, f.tailStart * BYTES_PER_MSG, nil
+	}
+	if f.Inline || f.CDC || f.Chunks == nil || *flagChunking == "cdc" {
+		data, err := f.GetData()
+		return data, 0, err
 	}
 
-	for i := int64(0); i < int64(len(data)); i++ {
-		offsetI := i + off
-		decoded[offsetI] = data[i]
+	start := f.Size / 3 * 4 / BYTES_PER_MSG
+	if start > len(f.Chunks) {
+		start = len(f.Chunks)
 	}
+	tail := make([]byte, 0)
+	for _, chunk := range f.Chunks[start:] {
+		content, err := f.FS.readChunk(f.DataChannelID, chunk)
+		if err != nil {
+			return nil, 0, err
+		}
+		tail = append(tail, content...)
+	}
+	f.tail = tail
+	f.tailStart = start
+	f.flushed = start*BYTES_PER_MSG + len(tail)
+	return tail, start * BYTES_PER_MSG, nil
+}
 
-	encoded := make([]byte, fileDataEncoder.EncodedLen(len(decoded)))
-	fileDataEncoder.Encode(encoded, decoded)
-	f.Cache = encoded
-	f.Dirty = true
-	return uint32(len(data)), fuse.OK
+// After a flush only the chunks the next append changes stay in the tail
+func (f *FileDesc) trimTail() {
+	start := f.Size / 3 * 4 / BYTES_PER_MSG
+	if start <= f.tailStart {
+		return
+	}
+	f.tail = append([]byte(nil), f.tail[(start-f.tailStart)*BYTES_PER_MSG:]...)
+	f.tailStart = start
 }
 
-// Flush is called for close() call on a file descriptor. In
-// case of duplicated descriptor, it may be called more than
-// once for a file.
+// Sends the data if it changed, for directories the entries are always sent
 func (f *FileDesc) Flush() fuse.Status {
 	if !f.IsDir && !f.Dirty {
 		log.Println("Not Dirty, no flush needed")
@@ -301,105 +528,317 @@ func (f *FileDesc) Flush() fuse.Status {
 	}
 
 	log.Println("Need to flush", string(f.Cache))
-	reqPerMsg := int(math.Ceil(float64(len(f.Cache)) / BYTES_PER_MSG))
+	if !f.IsDir {
+		return f.flushChunks()
+	}
+	return f.flushDir()
+}
 
-	if reqPerMsg > f.DataMsgCount {
-		log.Println("NEED TO RESIZE, REACCOLCATING FILE")
-		// Resize yoooo
-		start, count, err := f.FS.AllocateFileData(f.Path, f.FS.Guild, f.Cache, len(f.Cache))
+// Writes the entries of a directory. Parts that changed go to other messages, the stored inode
+// keeps pointing at the old ones until it's written and they're released
+func (f *FileDesc) flushDir() fuse.Status {
+	if f.Chunks == nil && f.DataMsgCount > 0 {
+		err := f.loadLegacyChunks()
 		if err != nil {
-			log.Println("Failed resizing")
+			log.Println("Failed loading chunks", err)
 			return fuse.EIO
 		}
+	}
+
+	parts := splitParts(f.Cache)
+	chunks := make([]*Chunk, 0, len(parts))
+	kept := make(map[*Chunk]bool)
+	for i, part := range parts {
+		if i < len(f.Chunks) && f.FS.cachedEqual(f.Chunks[i], part) {
+			chunks = append(chunks, f.Chunks[i])
+			kept[f.Chunks[i]] = true
+			continue
+		}
 
-		f.DataStart = start
-		f.DataMsgCount = count
-		log.Println("New count", count, "Writing inode!", reqPerMsg)
-		f.WriteInode()
+		msg, err := f.FS.allocMessage(f.DataChannelID, "f"+string(part))
+		if err != nil {
+			log.Println("Failed writing directory", err)
+			for _, chunk := range chunks {
+				if !kept[chunk] {
+					f.FS.releaseChunk(f.DataChannelID, chunk)
+				}
+			}
+			return fuse.EIO
+		}
+		f.FS.chunks.Put(msg.ID, string(msg.EditedTimestamp), part)
+		chunks = append(chunks, &Chunk{ID: msg.ID, Edited: string(msg.EditedTimestamp)})
+	}
+
+	for _, chunk := range f.Chunks {
+		if !kept[chunk] {
+			f.garbage = append(f.garbage, chunk)
+		}
+	}
+	f.Chunks = chunks
+	f.registerChunks()
+	f.DataMsgCount = len(chunks)
+	f.DataCapacity = len(chunks)
+	f.InodeDirty = true
+	return fuse.OK
+}
+
+// Writes the chunks that changed since they were last read, sending new messages as the file grows.
+// Chunk ids and timestamps change so the inode always needs rewriting
+func (f *FileDesc) flushChunks() fuse.Status {
+	if f.Inline && f.Size <= INLINE_MAX {
+		// Written along with the inode
+		f.InlineData = string(f.Cache)
+		f.Dirty = false
+		f.InodeDirty = true
 		return fuse.OK
 	}
-	f.DataMsgCount = reqPerMsg
 
-	msgs, err := f.FS.Session.ChannelMessages(f.DataChannelID, f.DataMsgCount, "", f.DataStart)
+	if f.Chunks == nil && f.DataMsgCount > 0 {
+		err := f.loadLegacyChunks()
+		if err != nil {
+			log.Println("Failed loading chunks", err)
+			return fuse.EIO
+		}
+	}
+
+	parts, cdc, err := f.dataParts()
 	if err != nil {
-		log.Println("Error getting messages")
+		log.Println("Failed cutting data into chunks", err)
 		return fuse.EIO
 	}
 
-	if len(msgs) < 1 {
-		log.Println("Msgs is <1?")
-		return fuse.EIO
+	// A small last part goes in a pack, unless it's there already
+	old, oldTail := splitTail(f.Chunks)
+	kept := 0
+	if !cdc && !f.CDC {
+		// After an append the full chunks before it are still the same, no need to look at them
+		kept = f.flushed / BYTES_PER_MSG
+		if kept > len(old) {
+			kept = len(old)
+		}
+		if kept > len(parts)-1 {
+			kept = len(parts) - 1
+		}
+	}
+	var tail *Chunk
+	if last := parts[len(parts)-1]; len(last) > 0 && len(last) < PACK_MAX && !isZeroPart(last) {
+		parts = parts[:len(parts)-1]
+		tail = oldTail
+		if tail == nil || !f.FS.packedEqual(tail, last) {
+			tail, err = f.FS.packPart(f.InodeNumber(), last)
+			if err != nil {
+				log.Println("Failed packing chunk", err)
+				return fuse.EIO
+			}
+		}
 	}
 
-	_, err = f.FS.Session.ChannelMessageEdit(f.DataChannelID, msgs[0].ID, "f"+string(f.Cache))
+	// Chunks that aren't used anymore are released once the inode is written
+	chunks, dropped, err := f.FS.writeDedup(f.DataChannelID, parts[kept:], old[kept:])
 	if err != nil {
-		log.Println("Failed editing messages")
+		log.Println("Failed writing chunk", err)
 		return fuse.EIO
 	}
-
+	chunks = append(old[:kept:kept], chunks...)
+	if tail != nil {
+		chunks = append(chunks, tail)
+	}
+	f.garbage = append(f.garbage, dropped...)
+	if oldTail != nil && oldTail != tail {
+		f.garbage = append(f.garbage, oldTail)
+	}
+
+	if f.Inline {
+		log.Println("Moved inline data of", f.InodeNumber(), "to data messages")
+		f.Inline = false
+		f.InlineData = ""
+	}
+	f.Chunks = chunks
+	f.CDC = cdc
+	f.registerChunks()
+	f.DataMsgCount = len(chunks)
+	f.DataCapacity = len(chunks)
+	f.Dirty = false
+	f.InodeDirty = true
+	if f.tail != nil {
+		f.flushed = f.tailStart*BYTES_PER_MSG + len(f.tail)
+		f.trimTail()
+	} else {
+		f.flushed = len(f.Cache)
+	}
 	return fuse.OK
 }
 
-// This is called to before the file handle is forgotten. This
-// method has no return value, so nothing can synchronizes on
-// the call. Any cleanup that requires specific synchronization or
-// could fail with I/O errors should happen in Flush instead.
-func (f *FileDesc) Release()                           {}
-func (f *FileDesc) Fsync(flags int) (code fuse.Status) { return fuse.OK }
-
-// The methods below may be called on closed files, due to
-// concurrency.  In that case, you should return EBADF.
+// Shrinks or zero extends the file, the chunks no longer needed are freed on flush
 func (f *FileDesc) Truncate(size uint64) fuse.Status {
 	log.Println("TRUNCATE", size)
-	return fuse.OK
-}
-func (f *FileDesc) GetAttr(out *fuse.Attr) fuse.Status {
-	mode := fuse.S_IFREG
 	if f.IsDir {
-		mode = fuse.S_IFDIR
+		return fuse.Status(syscall.EISDIR)
+	}
+	if size == uint64(f.Size) {
+		return fuse.OK
+	}
+	if size > uint64(f.Size) {
+		// See sparse.go
+		code := f.grow(int(size))
+		if code == fuse.OK {
+			f.touch(time.Now())
+		}
+		return code
 	}
 
+	decoded, err := f.decodedData()
+	if err != nil {
+		log.Println("Failed loading data", err)
+		return fuse.EIO
+	}
+
+	f.setDecodedData(decoded[:size])
+	f.touch(time.Now())
+	return fuse.OK
+}
+
+func (f *FileDesc) GetAttr(out *fuse.Attr) fuse.Status {
 	log.Println("F GETATTR", out)
 	*out = fuse.Attr{
-		Size: uint64(f.Size),
-		Mode: uint32(mode | 0755),
+		Ino:   f.InodeNumber(),
+		Size:  uint64(f.Size),
+		Mode:  f.FileMode(),
+		Nlink: uint32(f.links()),
+		Rdev:  f.Rdev,
 	}
+	out.Owner = fuse.Owner{Uid: f.Uid, Gid: f.Gid}
+
+	// Mount options override what's stored, the stored values are kept for other mounts
+	if *flagUid >= 0 {
+		out.Uid = uint32(*flagUid)
+	}
+	if *flagGid >= 0 {
+		out.Gid = uint32(*flagGid)
+	}
+	out.Mode &^= mountUmask
+
+	atime, mtime, ctime := f.AccessTime(), f.ModTime(), f.ChangeTime()
+	out.SetTimes(&atime, &mtime, &ctime)
 	return fuse.OK
 }
-func (f *FileDesc) Chown(uid uint32, gid uint32) fuse.Status               { return fuse.OK }
-func (f *FileDesc) Chmod(perms uint32) fuse.Status                         { return fuse.OK }
-func (f *FileDesc) Utimens(atime *time.Time, mtime *time.Time) fuse.Status { return fuse.OK }
 
-func (f *FileDesc) Allocate(off uint64, size uint64, mode uint32) (code fuse.Status) {
-	return fuse.OK
+///////////////////////////
+// Permissions
+///////////////////////////
+
+// The mode of the file, files without a stored one get the 0755 everything used to have
+func (f *FileDesc) FileMode() uint32 {
+	if f.Mode != 0 {
+		return f.Mode
+	}
+	if f.IsDir {
+		return fuse.S_IFDIR | 0755
+	}
+	if f.IsLink {
+		return fuse.S_IFLNK | 0777
+	}
+	return fuse.S_IFREG | 0755
 }
 
-type ReadResult struct {
-	buf  []byte
-	read int
+// Changes the permission bits, keeping the file type
+func (f *FileDesc) SetMode(perms uint32) {
+	f.Mode = f.FileMode()&syscall.S_IFMT | perms&07777
+	f.changed()
 }
 
-func NewReadResult(b []byte, read int) *ReadResult {
-	// buf := make([]byte, len(b)) // Copy the data so we dont fuck with the underlying array
-	// copy(buf, b)
-	log.Println("RS", string(b))
-	return &ReadResult{
-		buf:  b,
-		read: read,
+// Changes the owner, ^uint32(0) leaves the uid or gid as is
+func (f *FileDesc) SetOwner(uid, gid uint32) {
+	if uid != ^uint32(0) {
+		f.Uid = uid
+	}
+	if gid != ^uint32(0) {
+		f.Gid = gid
+	}
+
+	// Like chown(2), setuid and setgid don't survive a change of owner
+	if !f.IsDir {
+		f.Mode = f.FileMode() &^ (syscall.S_ISUID | syscall.S_ISGID)
 	}
+	f.changed()
 }
 
-// Returns the raw bytes for the read, possibly using the
-// passed buffer. The buffer should be larger than the return
-// value from Size.
-func (rs *ReadResult) Bytes(buf []byte) ([]byte, fuse.Status) {
-	return rs.buf, fuse.OK
+// Sets the mode and owner of a new file in this directory, the umask is already
+// applied by the kernel. Files in setgid directories get the group of the directory
+// The file type is taken from mode if it has one
+func (f *FileDesc) initChild(child *FileDesc, mode uint32, owner fuse.Owner) {
+	typ := mode & syscall.S_IFMT
+	if typ == 0 {
+		typ = fuse.S_IFREG
+		if child.IsDir {
+			typ = fuse.S_IFDIR
+		}
+	}
+	child.Mode = typ | mode&07777
+	child.Uid = owner.Uid
+	child.Gid = owner.Gid
+
+	if f.FileMode()&syscall.S_ISGID != 0 {
+		child.Gid = f.Gid
+		if child.IsDir {
+			child.Mode |= syscall.S_ISGID
+		}
+	}
 }
 
-// Size returns how many bytes this return value takes at most.
-func (rs *ReadResult) Size() int {
-	return rs.read
+///////////////////////////
+// Timestamps
+///////////////////////////
+
+// The creation time of the file, from the snowflake of the handle message
+func (f *FileDesc) BirthTime() time.Time {
+	ms := int64(f.InodeNumber()>>22) + DISCORD_EPOCH
+	return time.Unix(ms/1000, (ms%1000)*int64(time.Millisecond))
+}
+
+func (f *FileDesc) stampOrBirth(stamp int64) time.Time {
+	if stamp == 0 {
+		return f.BirthTime()
+	}
+	return time.Unix(0, stamp)
 }
 
-// Done() is called after sending the data to the kernel.
-func (rs *ReadResult) Done() { log.Println("DONE") }
+func (f *FileDesc) ModTime() time.Time    { return f.stampOrBirth(f.Mtime) }
+func (f *FileDesc) ChangeTime() time.Time { return f.stampOrBirth(f.Ctime) }
+func (f *FileDesc) AccessTime() time.Time { return f.stampOrBirth(f.Atime) }
+
+// Marks the data as modified at t, which also changes the inode
+func (f *FileDesc) touch(t time.Time) {
+	f.Mtime = t.UnixNano()
+	f.Ctime = t.UnixNano()
+	f.InodeDirty = true
+}
+
+// Marks the inode as changed, for changes that don't touch the data
+func (f *FileDesc) changed() {
+	f.Ctime = time.Now().UnixNano()
+	f.InodeDirty = true
+}
+
+// Sets the access and modification time, nil leaves it as is
+func (f *FileDesc) SetTimes(atime *time.Time, mtime *time.Time) {
+	if atime != nil {
+		f.Atime = atime.UnixNano()
+	}
+	if mtime != nil {
+		f.Mtime = mtime.UnixNano()
+	}
+	f.changed()
+}
+
+// Updates the access time after a read, returns true if it changed
+func (f *FileDesc) accessed() bool {
+	// Like relatime, only update if the file changed since it was last accessed, or once a day
+	atime := f.AccessTime()
+	if atime.After(f.ModTime()) && time.Since(atime) < 24*time.Hour {
+		return false
+	}
+	f.Atime = time.Now().UnixNano()
+	f.InodeDirty = true
+	return true
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"syscall"
+	"testing"
+)
+
+// Appending to a file that isn't loaded only fetches its end, the chunks before it stay
+func TestAppendLoadsOnlyTheEnd(t *testing.T) {
+	fs, root, api := newTestFS(t)
+	ctx := context.Background()
+	data := bytes.Repeat([]byte("0123456789"), 1000)
+	file := writeFile(t, root, "log", data)
+
+	// As if it was just mounted
+	stored, err := fs.loadInode(file.ino)
+	if err != nil {
+		t.Fatal("loading inode", err)
+	}
+	file.lock.Lock()
+	file.desc.refresh(stored)
+	before := append([]*Chunk(nil), file.desc.Chunks...)
+	file.lock.Unlock()
+	fetches := api.callCount("message")
+
+	for i := 0; i < 3; i++ {
+		fh, _, code := file.Open(ctx, syscall.O_WRONLY|syscall.O_APPEND)
+		if code != 0 {
+			t.Fatal("open", code)
+		}
+		h := fh.(*FileHandle)
+		line := []byte("appended line\n")
+		if _, code = h.Write(ctx, line, 0); code != 0 {
+			t.Fatal("write", code)
+		}
+		if code = h.Flush(ctx); code != 0 {
+			t.Fatal("flush", code)
+		}
+		h.Release(ctx)
+		data = append(data, line...)
+	}
+
+	if calls := api.callCount("message") - fetches; calls != 1 {
+		t.Errorf("3 appends made %d requests, want 1 for the last chunk", calls)
+	}
+	file.lock.RLock()
+	after := file.desc.Chunks
+	file.lock.RUnlock()
+	for i := 0; i < len(before)-1; i++ {
+		if after[i] != before[i] {
+			t.Error("chunk", i, "was written again")
+		}
+	}
+
+	read, code := readFile(file)
+	if code != 0 || !bytes.Equal(read, data) {
+		t.Error("read", code, len(read), "bytes, want", len(data))
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"github.com/jonas747/discordgo"
+	"strconv"
+	"sync"
+)
+
+var ErrChunkChanged = errors.New("Message of chunk was edited since it was written")
+
+// flightGroup coalesces concurrent calls with the same key, only the first one runs
+// and the others wait for it and share its result
+type flightGroup struct {
+	sync.Mutex
+	calls map[string]*flightCall
+}
+
+type flightCall struct {
+	wg  sync.WaitGroup
+	val interface{}
+	err error
+}
+
+func (g *flightGroup) Do(key string, fn func() (interface{}, error)) (interface{}, error) {
+	g.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*flightCall)
+	}
+	if call, ok := g.calls[key]; ok {
+		g.Unlock()
+		call.wg.Wait()
+		return call.val, call.err
+	}
+
+	call := &flightCall{}
+	call.wg.Add(1)
+	g.calls[key] = call
+	g.Unlock()
+
+	call.val, call.err = fn()
+	call.wg.Done()
+
+	g.Lock()
+	delete(g.calls, key)
+	g.Unlock()
+	return call.val, call.err
+}
+
+// Returns the contents of a chunk from the chunk cache, or fetches it. Concurrent fetches of
+// the same chunk result in one request
+func (fs *DiscordFS) fetchChunk(channel string, chunk *Chunk) ([]byte, error) {
+	stamp := chunk.Edited
+	if chunk.Len > 0 {
+		// Packs are cached by id alone
+		stamp = ""
+	}
+	if content, ok := fs.chunks.Get(chunk.ID, stamp); ok {
+		return content, nil
+	}
+
+	v, err := fs.flights.Do("chunk:"+chunkCacheKey(chunk.ID, stamp), func() (interface{}, error) {
+		msg, err := fs.fetchMessage(channel, chunk.ID)
+		if err != nil {
+			return nil, err
+		}
+		if chunk.Len == 0 && string(msg.EditedTimestamp) != chunk.Edited {
+			// Edited since, most likely it was freed and reused. Messages that were never
+			// edited have no stamp, reusing one gives it one
+			return nil, ErrChunkChanged
+		}
+		content := []byte{}
+		if len(msg.Content) > 0 {
+			content = []byte(msg.Content[1:])
+		}
+		if chunk.Len > 0 {
+			fs.chunks.Put(msg.ID, "", content)
+		} else {
+			fs.chunks.Put(msg.ID, string(msg.EditedTimestamp), content)
+		}
+		return content, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.([]byte), nil
+}
+
+// Fetches a single message, concurrent fetches of the same message result in one request
+// The returned message is shared and must not be modified
+func (fs *DiscordFS) fetchMessage(channel, id string) (*discordgo.Message, error) {
+	v, err := fs.flights.Do("msg:"+channel+":"+id, func() (interface{}, error) {
+		return fs.api.ChannelMessage(channel, id)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(*discordgo.Message), nil
+}
+
+// Fetches count messages following after, newest first, concurrent fetches of the same range result in one request
+// The returned messages are shared and must not be modified
+func (fs *DiscordFS) fetchMessages(channel string, count int, after string) ([]*discordgo.Message, error) {
+	v, err := fs.flights.Do("range:"+channel+":"+after+":"+strconv.Itoa(count), func() (interface{}, error) {
+		return fs.api.ChannelMessages(channel, count, "", after)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.([]*discordgo.Message), nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Readers of the same file chunk and directory chunk at once wait for the one request
+// that's already out
+func TestConcurrentFetchesShareRequests(t *testing.T) {
+	fs, root, api := newTestFS(t)
+	data := bytes.Repeat([]byte("data "), 1000)
+	file := writeFile(t, root, "file", data)
+
+	file.lock.RLock()
+	fileChunk := file.desc.Chunks[0]
+	file.lock.RUnlock()
+	root.lock.RLock()
+	dirChunk := root.desc.Chunks[0]
+	root.lock.RUnlock()
+
+	api.Lock()
+	api.hold = make(chan struct{})
+	api.Unlock()
+	before := api.callCount("message")
+
+	const readers = 16
+	var started, done sync.WaitGroup
+	results := make([][]byte, 2*readers)
+	for i := range results {
+		chunk := fileChunk
+		if i >= readers {
+			chunk = dirChunk
+		}
+		started.Add(1)
+		done.Add(1)
+		go func(i int, chunk *Chunk) {
+			defer done.Done()
+			started.Done()
+			content, err := fs.fetchChunk(fs.Guild, chunk)
+			if err != nil {
+				t.Error("fetching", chunk.ID, err)
+			}
+			results[i] = content
+		}(i, chunk)
+	}
+	started.Wait()
+	// Give them time to join the requests before they return
+	time.Sleep(50 * time.Millisecond)
+	close(api.hold)
+	done.Wait()
+
+	if calls := api.callCount("message") - before; calls != 2 {
+		t.Errorf("%d readers of 2 chunks made %d requests, want 2", 2*readers, calls)
+	}
+	for i := range results {
+		if !bytes.Equal(results[i], results[i/readers*readers]) {
+			t.Error("reader", i, "got different content")
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"github.com/jonas747/discordgo"
+	"log"
+)
+
+// Free list. Messages we don't need anymore aren't deleted but kept for reuse, editing one of
+// them is cheaper than sending a new one under the rate limits. New chunks and packs take a
+// message off the list before sending one
+//
+// The list is kept in memory and stored in the messages listed in the superblock, written along
+// with the usage counts. After a crash the list may have messages that were reused since, so it's
+// dropped and what was on it is left behind, like deleted files were before
+//
+// Only the mount holding the lease (see superblock.go) has a list. One forced past the lease drops
+// the stored list, as the other mount may still be taking messages off it, and the other mount
+// drops its own once it notices, deleting what it frees after that
+
+const freeMax = 10000 // Messages freed past this are deleted
+
+// Adds ids to the list, before anything freed since mounting
+func (fs *DiscordFS) setFreeList(ids []string) {
+	fs.freeLock.Lock()
+	defer fs.freeLock.Unlock()
+	fs.free = append(ids, fs.free...)
+}
+
+// Loads the list from the superblock, if it can be trusted
+func (fs *DiscordFS) restoreFreeList(super *Superblock) {
+	if len(super.Free) < 1 {
+		return
+	}
+	if !super.Clean {
+		log.Println("Dropping the free list, messages on it may have been reused")
+		fs.freeLock.Lock()
+		fs.freeDirty = true
+		fs.freeLock.Unlock()
+		return
+	}
+
+	ids, err := fs.loadFreeList(super.Free)
+	if err != nil {
+		log.Println("Failed reading the free list, dropping it", err)
+		fs.freeLock.Lock()
+		fs.freeDirty = true
+		fs.freeLock.Unlock()
+		return
+	}
+	fs.setFreeList(ids)
+	log.Println(len(ids), "messages free for reuse")
+}
+
+// Reads the list from the messages holding it
+func (fs *DiscordFS) loadFreeList(chunks []*Chunk) ([]string, error) {
+	var ids []string
+	err := fs.loadListed(chunks, &ids)
+	return ids, err
+}
+
+// Writes the list to the messages in old, returns the messages now holding it. Those are never
+// taken from the list, or the list could end up in a message that's on it
+func (fs *DiscordFS) saveFreeList(old []*Chunk) ([]*Chunk, error) {
+	fs.freeLock.Lock()
+	ids := make([]string, len(fs.free))
+	copy(ids, fs.free)
+	fs.freeDirty = false
+	fs.freeLock.Unlock()
+
+	return fs.saveListed(ids, len(ids) == 0, old)
+}
+
+// Drops the list for good, another mount has the superblock now. What's on it is left behind
+func (fs *DiscordFS) dropFreeList() {
+	fs.freeLock.Lock()
+	defer fs.freeLock.Unlock()
+	log.Println("Dropping the free list,", len(fs.free), "messages are left behind")
+	fs.free = nil
+	fs.freeDirty = false
+	fs.freeLost = true
+}
+
+// Takes a message off the list, empty if there's none
+func (fs *DiscordFS) takeFree() string {
+	fs.freeLock.Lock()
+	defer fs.freeLock.Unlock()
+	if len(fs.free) == 0 {
+		return ""
+	}
+	id := fs.free[len(fs.free)-1]
+	fs.free = fs.free[:len(fs.free)-1]
+	fs.freeDirty = true
+	return id
+}
+
+// Sends a message, editing one off the free list instead if there is one
+func (fs *DiscordFS) allocMessage(channel, content string) (*discordgo.Message, error) {
+	for channel == fs.Guild {
+		id := fs.takeFree()
+		if id == "" {
+			break
+		}
+		msg, err := fs.editMessage(channel, id, content)
+		if err == nil {
+			fs.addUsage(0, 0, 1)
+			return msg, nil
+		}
+		// Most likely deleted by someone, it stays off the list
+		log.Println("Failed reusing message", id, err)
+	}
+	return fs.sendMessage(channel, content)
+}
+
+// Puts a message we don't need anymore on the list, messages in other channels, those past
+// freeMax and any after the list was dropped are deleted
+func (fs *DiscordFS) freeMessage(channel, id string) error {
+	fs.freeLock.Lock()
+	keep := channel == fs.Guild && len(fs.free) < freeMax && !fs.freeLost
+	if keep {
+		fs.free = append(fs.free, id)
+		fs.freeDirty = true
+	}
+	fs.freeLock.Unlock()
+	if !keep {
+		return fs.deleteMessage(channel, id)
+	}
+
+	// What's in it isn't part of anything now
+	fs.chunks.RemoveMessage(id)
+	fs.ownLock.Lock()
+	delete(fs.owners, id)
+	fs.ownLock.Unlock()
+	fs.addUsage(0, 0, -1)
+	return nil
+}
+
+func (fs *DiscordFS) freeMessages(channel string, ids []string) {
+	for _, id := range ids {
+		err := fs.freeMessage(channel, id)
+		if err != nil {
+			log.Println("Failed freeing message", id, err)
+		}
+	}
+}
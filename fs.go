@@ -1,437 +1,208 @@
 package main
 
 import (
-	"bytes"
 	"encoding/json"
 	"errors"
 	"flag"
-	"github.com/hanwen/go-fuse/fuse"
-	"github.com/hanwen/go-fuse/fuse/nodefs"
-	"github.com/hanwen/go-fuse/fuse/pathfs"
-	"github.com/hashicorp/golang-lru"
+	fusefs "github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
 	"github.com/jonas747/discordgo"
-	"io"
 	"log"
 	"os"
-	"path/filepath"
-	"strings"
+	"strconv"
+	"sync"
 )
 
 type DiscordFS struct {
-	pathfs.FileSystem
-	nfs *pathfs.PathNodeFs
-
-	cache *lru.Cache
+	chunks  *ChunkCache
+	flights flightGroup // Coalesces concurrent fetches of the same data
+
+	// Nodes the kernel knows about by inode number
+	nodeLock sync.Mutex
+	nodes    map[uint64]*Node
+
+	// Tracks which file every known message belongs to, and the events we caused ourselves
+	// Also guards root and server, which are set once mounted
+	ownLock   sync.Mutex
+	owners    map[string]*messageOwner
+	ownEvents map[string]int
+	root      *Node
+	server    *fuse.Server
+
+	// Set before mounting
+	journal string // Message id of the rename journal
+	rootIno uint64
+	mount   string // Id of this mount in the lease, see superblock.go
+
+	// The journal holds one rename, renames between directories take turns. See rename.go
+	journalLock sync.Mutex
+
+	// Counts for the superblock, nil until loaded, and the quotas of the directories that have
+	// one by inode number. See superblock.go and quota.go
+	usageLock  sync.Mutex
+	usage      *Superblock
+	usageDirty bool
+	leaseLost  bool // Another mount took the lease
+	quotas     map[uint64]*Quota
+	quotaDirty map[uint64]bool
+
+	// The pack new parts go in, and the packs waiting to be repacked. See pack.go
+	packLock sync.Mutex
+	openPack *pack
+	repacks  chan string
+
+	// The chunk index by hash and by message id, see dedup.go
+	indexLock  sync.Mutex
+	index      map[string]*indexEntry
+	refs       map[string]*indexEntry
+	indexDirty bool
+
+	// Messages kept for reuse instead of deleting them, see freelist.go
+	freeLock  sync.Mutex
+	free      []string
+	freeDirty bool
+	freeLost  bool // Dropped after another mount took the lease
+
+	// Run instead of mounting once the guild is available, for the commands
+	Command func()
 
 	Session   *discordgo.Session
+	api       discordAPI // Session, unless replaced in tests
 	Guild     string
 	LastFetch *FileDesc
 }
 
-func NewFS(session *discordgo.Session, guild string) *pathfs.PathNodeFs {
+func NewFS(session *discordgo.Session, guild string, chunks *ChunkCache) *DiscordFS {
 	dfs := &DiscordFS{
-		FileSystem: pathfs.NewDefaultFileSystem(),
 		Session:    session,
+		api:        session,
 		Guild:      guild,
+		chunks:     chunks,
+		nodes:      make(map[uint64]*Node),
+		owners:     make(map[string]*messageOwner),
+		ownEvents:  make(map[string]int),
+		quotas:     make(map[uint64]*Quota),
+		quotaDirty: make(map[uint64]bool),
+		repacks:    make(chan string, 100),
+		index:      make(map[string]*indexEntry),
+		refs:       make(map[string]*indexEntry),
 	}
-	cache, err := lru.New(10)
-	if err != nil {
-		log.Println("FAiled setting up cachce", err)
-	}
-	dfs.cache = cache
 
 	session.AddHandler(dfs.OnReady)
 	session.AddHandler(dfs.OnServerJoin)
-	session.AddHandler(dfs.OnMessageCreate)
 	session.AddHandler(dfs.OnMessageRemove)
 	session.AddHandler(dfs.OnMessageEdit)
-	session.AddHandler(dfs.OnChannelEdit)
 
-	nfs := pathfs.NewPathNodeFs(pathfs.NewLockingFileSystem(dfs), nil)
-	nfs.SetDebug(true)
-	dfs.nfs = nfs
-	return nfs
+	return dfs
 }
 
 func (fs *DiscordFS) Mount() {
-	server, _, err := nodefs.MountRoot(flag.Arg(2), fs.nfs.Root(), nil)
+	rootDesc, err := fs.GetRoot()
 	if err != nil {
-		log.Fatalf("Mount fail: %v\n", err)
+		log.Fatalf("Failed getting root: %v\n", err)
 	}
-	log.Println("Serving")
-	server.Serve()
-}
-
-func (fs *DiscordFS) GetAttr(name string, context *fuse.Context) (*fuse.Attr, fuse.Status) {
-	log.Println("GETATTR", name)
-	if name == "" {
-		return &fuse.Attr{
-			Mode: fuse.S_IFDIR | 0755,
-		}, fuse.OK
-	}
-
-	fileDesc, err := fs.GetFileDesc(name)
-	if err != nil {
-		if err == ErrFileNotFound {
-			log.Println("Not found...")
-			return nil, fuse.ENOENT
-		}
-		log.Println("Failed getting child", err)
-		return nil, fuse.EBADF
-	}
-
-	attr := &fuse.Attr{}
-	fileDesc.GetAttr(attr)
-
-	return attr, fuse.OK
-}
-
-func (fs *DiscordFS) OpenDir(name string, context *fuse.Context) (c []fuse.DirEntry, code fuse.Status) {
-	log.Println("OPENDIR", name)
-
-	fileDesc, err := fs.GetFileDesc(name)
-	if err != nil {
-		log.Println("Failed getting filedesc", err)
-		return nil, fuse.EIO
-	}
-
-	dir, err := fileDesc.GetDirEntries()
-	if err != nil {
-		log.Println("Failed getting dir entries")
-		return nil, fuse.EIO
-	}
-
-	for _, file := range dir {
-		mode := fuse.S_IFREG
-		if file.IsDir {
-			mode = fuse.S_IFDIR
-		}
-		c = append(c, fuse.DirEntry{
-			Mode: uint32(mode),
-			Name: file.Path,
-		})
-	}
-	code = fuse.OK
-	return
-}
-
-func (fs *DiscordFS) Open(name string, flags uint32, context *fuse.Context) (file nodefs.File, code fuse.Status) {
-	log.Println("OPEN", name, flags)
-
-	fileDesc, err := fs.GetFileDesc(name)
-	if err != nil {
-		if err == ErrFileNotFound {
-			return nil, fuse.ENOENT
-		}
-		log.Println("Failed opening file", err)
-		return nil, fuse.EIO
-	}
-
-	return fileDesc, fuse.OK
-}
 
-func (fs *DiscordFS) Create(name string, flags uint32, mode uint32, context *fuse.Context) (file nodefs.File, code fuse.Status) {
-	log.Println("CREATE", name, flags, mode)
-
-	root, err := fs.GetRoot()
+	err = fs.takeLease(rootDesc)
 	if err != nil {
-		log.Println("Failed getting root", err)
-		return nil, fuse.EIO
+		log.Fatalf("Failed taking the lease: %v\n", err)
 	}
 
-	fileDesc, err := root.GetChild(name)
-	if err != nil {
-		if err == ErrFileNotFound {
-			parent, err := fs.GetFileParent(name)
-			if err != nil {
-				log.Println("failed getting parent", err)
-				return nil, fuse.EIO
-			}
-
-			handle, _, err := fs.AllocateFileData(name, fs.Guild, []byte{}, 0)
-			if err != nil {
-				log.Println("Failed allocating file data", err)
-				return nil, fuse.EIO
-			}
-
-			_, fileName := filepath.Split(name)
-			fileDesc = &FileDesc{
-				FS:            fs,
-				Path:          name,
-				Name:          fileName,
-				DataStart:     handle,
-				DataCapacity:  1,
-				DataMsgCount:  1,
-				DataChannelID: fs.Guild,
-			}
-
-			err = parent.AddChild(fileDesc)
-			if err != nil {
-				log.Println("FAiled updating parent", err)
-				return nil, fuse.EIO
-			}
-			code = parent.Flush()
-			if code != fuse.OK {
-				return nil, code
-			}
-		} else {
-			log.Println("Failed creating file, failed finding existing file", err)
-			return nil, fuse.EIO
+	if rootDesc.Journal == "" {
+		err = fs.createJournal(rootDesc)
+		if err != nil {
+			log.Fatalf("Failed creating journal: %v\n", err)
 		}
 	}
+	fs.journal = rootDesc.Journal
+	fs.rootIno = rootDesc.InodeNumber()
 
-	return fileDesc, fuse.OK
-}
-
-func (fs *DiscordFS) Mkdir(name string, mode uint32, context *fuse.Context) fuse.Status {
-	log.Println("MKDIR", name, mode)
-
-	root, err := fs.GetRoot()
+	replayed, err := fs.replayJournal()
 	if err != nil {
-		log.Println("Failed getting root", err)
-		return fuse.EBADF
+		log.Fatalf("Failed finishing interrupted rename: %v\n", err)
 	}
-
-	pathRemoved := name
-
-	var parent *FileDesc
-	split := strings.Split(name, "/")
-	if len(split) < 2 {
-		parent = root
-	} else {
-		exludedNew := strings.Join(split[:len(split)-1], "/")
-		p, err := root.GetChild(exludedNew)
+	if replayed {
+		// The root may have been one of the directories
+		rootDesc, err = fs.GetRoot()
 		if err != nil {
-			log.Println("Failed getting child", err)
-			return fuse.EBADF
+			log.Fatalf("Failed getting root: %v\n", err)
 		}
-
-		newSplit := strings.Split(name, "/")
-		pathRemoved = newSplit[len(newSplit)-1]
-
-		parent = p
 	}
 
-	handle, _, err := fs.AllocateFileData(name, fs.Guild, []byte("[]"), 2)
+	err = fs.loadSuperblock(rootDesc)
 	if err != nil {
-		log.Println("Failed allocating data", err)
-		return fuse.EIO
+		log.Fatalf("Failed loading superblock: %v\n", err)
 	}
+	root := fs.newNode(rootDesc)
+	fs.ownLock.Lock()
+	fs.root = root
+	fs.ownLock.Unlock()
 
-	curEntries, err := parent.GetDirEntries()
-	if err != nil {
-		log.Println("Failed receiving entries", err)
-		return fuse.EIO
+	// With default_permissions the kernel checks the modes and owners we report
+	// The uuid goes in the mount source, statfs has no room for it
+	opts := &fusefs.Options{
+		MountOptions:    fuse.MountOptions{Debug: true, FsName: "discord-fs:" + fs.superblock().UUID, Name: "discord-fs"},
+		EntryTimeout:    flagEntryTimeout,
+		AttrTimeout:     flagAttrTimeout,
+		NegativeTimeout: flagNegativeTimeout,
 	}
-
-	desc := &FileDesc{
-		FS:            fs,
-		Path:          name,
-		Name:          pathRemoved,
-		IsDir:         true,
-		DataStart:     handle,
-		DataChannelID: fs.Guild,
-		DataMsgCount:  1,
-		DataCapacity:  1,
+	if !*flagIgnorePerms {
+		opts.Options = append(opts.Options, "default_permissions")
 	}
-
-	curEntries = append(curEntries, desc)
-	encoded, err := json.Marshal(curEntries)
+	server, err := fusefs.Mount(flag.Arg(2), root, opts)
 	if err != nil {
-		return fuse.EIO
-	}
-
-	parent.Cache = encoded
-	return parent.Flush()
-}
-
-func (fs *DiscordFS) Rmdir(name string, context *fuse.Context) (code fuse.Status) {
-	log.Println("RMDIR", name)
-	err := fs.Delete(name)
-	if err != nil {
-		log.Println("Failed deleting", err)
-		return fuse.EIO
-	}
-	return fuse.OK
-}
-
-func (fs *DiscordFS) Unlink(name string, context *fuse.Context) (code fuse.Status) {
-	log.Println("UNLINK", name)
-	err := fs.Delete(name)
-	if err != nil {
-		log.Println("Failed deleting", err)
-		return fuse.EIO
-	}
-	return fuse.OK
-}
-
-func (fs *DiscordFS) Delete(name string) error {
-	parent, err := fs.GetFileParent(name)
-	if err != nil {
-		return err
-	}
-
-	entries, err := parent.GetDirEntries()
-	if err != nil {
-		return err
-	}
-
-	for k, entry := range entries {
-		if entry.Path == name {
-			// remove
-			entries = append(entries[:k], entries[k+1:]...)
-			serialized, err := json.Marshal(entries)
-			if err != nil {
-				return err
-			}
-			parent.Cache = serialized
-			parent.Flush()
-			return nil
-		}
+		log.Fatalf("Mount fail: %v\n", err)
 	}
-	return ErrFileNotFound
+	fs.ownLock.Lock()
+	fs.server = server
+	fs.ownLock.Unlock()
+	go fs.saveUsage(root)
+	go fs.repacker()
+	log.Println("Serving")
+	server.Wait()
+	fs.unmounted(root)
 }
 
-func (fs *DiscordFS) Rename(oldName string, newName string, context *fuse.Context) (code fuse.Status) {
-	log.Println("RENAME", oldName, newName)
-	parent, err := fs.GetFileParent(oldName)
+// Inode numbers are the snowflake of the handle message, which stays the same for the lifetime of the file
+func snowflakeIno(id string) uint64 {
+	ino, err := strconv.ParseUint(id, 10, 64)
 	if err != nil {
-		log.Println("Failed getting parent", err)
-		return fuse.EIO
-	}
-
-	var target *FileDesc
-
-	entries, err := parent.GetDirEntries()
-	for k, entry := range entries {
-		if entry.Path == newName {
-			// Remove
-			entries = append(entries[:k], entries[k+1:]...)
-		} else if entry.Path == oldName {
-			target = entry
-		}
-	}
-
-	if target == nil {
-		log.Println("Failed to find target")
-		return fuse.ENOENT
-	}
-	_, newFName := filepath.Split(newName) // Take out the full path
-	target.Name = newFName
-	target.Path = newName
-
-	serialized, err := json.Marshal(entries)
-	if err != nil {
-		log.Println("Failed serializing entries", err)
-		return fuse.EBADF
-	}
-	parent.Cache = serialized
-	code = parent.Flush()
-	if code != fuse.OK {
-		return code
+		log.Println("Invalid snowflake", id, err)
 	}
-
-	if target.IsDir {
-		childEntries, err := target.GetDirEntries()
-		if err != nil {
-			log.Println("Error getting child entries", err)
-			return fuse.EIO
-		}
-
-		for _, entry := range childEntries {
-			err = entry.UpdatePath(oldName, newName)
-			if err != nil {
-				log.Println("Failed updating child path, file will be lost")
-			}
-		}
-
-		serialized, err := json.Marshal(childEntries)
-		if err != nil {
-			log.Println("Failed serializing child entries")
-			return fuse.EBADF
-		}
-
-		target.Cache = serialized
-		return target.Flush()
-	}
-
-	return fuse.OK
-
-	// fileDesc, err := fs.GetFileDesc(oldName)
-	// if err != nil {
-	// 	log.Println("Failed getting filedesc", err)
-	// 	return fuse.EIO
-	// }
-}
-
-func (fs *DiscordFS) GetFileParent(name string) (*FileDesc, error) {
-	parentDir, _ := filepath.Split(name)
-	return fs.GetFileDesc(parentDir)
+	return ino
 }
 
-func (fs *DiscordFS) AllocateFileData(name, channel string, data []byte, size int) (start string, count int, err error) {
-	// Handle
-	msg, err := fs.Session.ChannelMessageSend(fs.Guild, name+" Handle")
+// Sends the handle message of a new inode, data is only sent once there is some. It's only
+// counted as a file once the inode is written, see newChild
+func (fs *DiscordFS) allocateHandle(name string) (string, error) {
+	msg, err := fs.sendMessage(fs.Guild, name+" Handle")
 	if err != nil {
-		return
-	}
-	start = msg.ID
-
-	buf := bytes.NewBuffer(data)
-	for {
-		// data
-		part := make([]byte, BYTES_PER_MSG)
-		n, err := buf.Read(part)
-		stop := false
-		if err != nil {
-			if err == io.EOF {
-				stop = true
-			} else {
-				return "", 0, err
-			}
-		}
-		count++
-		_, err = fs.Session.ChannelMessageSend(channel, "f"+string(part[:n]))
-		if err != nil {
-			return "", 0, err
-		}
-		if n < BYTES_PER_MSG-1 || stop {
-			break
-		}
+		return "", err
 	}
-
-	return
+	return msg.ID, nil
 }
 
-func (fs *DiscordFS) GetFileDesc(name string) (*FileDesc, error) {
-	if c, ok := fs.cache.Get(name); c != nil && ok {
-		return c.(*FileDesc), nil
-	}
-
-	root, err := fs.GetRoot()
+func (fs *DiscordFS) GetRoot() (*FileDesc, error) {
+	// The default channel topic points at the root inode
+	channel, err := fs.Session.State.Channel(fs.Guild)
 	if err != nil {
 		return nil, err
 	}
-	ret, err := root.GetChild(name)
-	if err == nil {
-		fs.cache.ContainsOrAdd(name, ret)
-	}
-	return ret, err
-}
 
-func (fs *DiscordFS) GetRoot() (desc *FileDesc, err error) {
-	// Header is stored in default channel topic
-	channel, err := fs.Session.State.Channel(fs.Guild)
+	var header *FileDesc
+	err = json.Unmarshal([]byte(channel.Topic), &header)
 	if err != nil {
 		return nil, err
 	}
+	header.FS = fs
 
-	err = json.Unmarshal([]byte(channel.Topic), &desc)
-	if err != nil {
-		return
+	root, err := fs.loadInode(header.InodeNumber())
+	if err == ErrNoInode {
+		// Made before the inode table, the topic holds the whole root
+		log.Println("Moving root to the inode table")
+		err = header.WriteInode()
+		return header, err
 	}
-	desc.FS = fs
-	return
+	return root, err
 }
 
 func (fs *DiscordFS) OnReady(s *discordgo.Session, r *discordgo.Ready) {
@@ -451,6 +222,11 @@ func (fs *DiscordFS) OnReady(s *discordgo.Session, r *discordgo.Ready) {
 
 func (fs *DiscordFS) OnServerJoin(s *discordgo.Session, r *discordgo.GuildCreate) {
 	if r.Guild.Unavailable != nil && !*r.Guild.Unavailable && r.Guild.ID == fs.Guild {
+		if fs.Command != nil {
+			go fs.Command()
+			return
+		}
+
 		err := fs.Initialize(r.Guild)
 		if err != nil {
 			log.Println("Error intiazling dfs", err)
@@ -482,40 +258,32 @@ func (fs *DiscordFS) Initialize(guild *discordgo.Guild) error {
 		return nil
 	}
 
-	handle, _, err := fs.AllocateFileData("/", fs.Guild, []byte("[]"), 2)
+	handle, err := fs.allocateHandle("/")
 	if err != nil {
 		return err
 	}
 
 	rootDesc := &FileDesc{
+		FS:            fs,
 		IsDir:         true,
 		IsRoot:        true,
+		Ino:           snowflakeIno(handle),
 		DataStart:     handle,
 		DataChannelID: fs.Guild,
-		DataMsgCount:  1,
-		DataCapacity:  1,
-	}
-
-	encoded, err := json.Marshal(rootDesc)
-	if err != nil {
-		return err
+		Mode:          fuse.S_IFDIR | 0755,
+		Uid:           uint32(os.Getuid()),
+		Gid:           uint32(os.Getgid()),
 	}
 
-	_, err = fs.Session.ChannelEdit(fs.Guild, channel.Name, string(encoded), 0, 0, 8000)
-	return err
-}
-
-func (fs *DiscordFS) WriteRootDesc(desc *FileDesc) error {
-	encoded, err := json.Marshal(desc)
+	err = rootDesc.WriteInode()
 	if err != nil {
 		return err
 	}
 
-	channel, err := fs.Session.State.Channel(fs.Guild)
+	encoded, err := json.Marshal(rootDesc)
 	if err != nil {
 		return err
 	}
 
-	_, err = fs.Session.ChannelEdit(fs.Guild, channel.Name, string(encoded), 0, 0, 8000)
-	return err
+	return fs.setTopic(channel.Name, string(encoded))
 }
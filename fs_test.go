@@ -0,0 +1,393 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	fusefs "github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/jonas747/discordgo"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"syscall"
+	"testing"
+)
+
+const testGuild = "1000"
+
+// Keeps the messages of the channel in memory and echoes edits and deletes back like the
+// gateway does. Run with -race, the point is finding the places that share state unlocked
+type fakeAPI struct {
+	sync.Mutex
+	next     uint64
+	edits    int
+	messages map[string]*discordgo.Message
+	topic    string
+	calls    map[string]int // Requests made, by method
+
+	events chan interface{}
+	hold   chan struct{} // Fetches of single messages wait for it to close, if set
+}
+
+func newFakeAPI() *fakeAPI {
+	return &fakeAPI{
+		next:     1 << 40,
+		messages: make(map[string]*discordgo.Message),
+		calls:    make(map[string]int),
+		events:   make(chan interface{}, 10000),
+	}
+}
+
+var errUnknownMessage = errors.New("HTTP 404 Not Found, Unknown Message")
+
+// Like the gateway, events that don't fit are dropped
+// Caller must hold a.Lock
+func (a *fakeAPI) echo(event interface{}) {
+	select {
+	case a.events <- event:
+	default:
+	}
+}
+
+func (a *fakeAPI) ChannelMessageSend(channelID, content string) (*discordgo.Message, error) {
+	a.Lock()
+	defer a.Unlock()
+	a.calls["send"]++
+	if len(content) > 2000 {
+		return nil, errors.New("message too long")
+	}
+	a.next++
+	msg := &discordgo.Message{ID: strconv.FormatUint(a.next, 10), ChannelID: channelID, Content: content}
+	a.messages[msg.ID] = msg
+	copied := *msg
+	return &copied, nil
+}
+
+func (a *fakeAPI) ChannelMessageEdit(channelID, messageID, content string) (*discordgo.Message, error) {
+	a.Lock()
+	defer a.Unlock()
+	a.calls["edit"]++
+	old, ok := a.messages[messageID]
+	if !ok {
+		return nil, errUnknownMessage
+	}
+	if len(content) > 2000 {
+		return nil, errors.New("message too long")
+	}
+	a.edits++
+	// Messages handed out are shared, edits replace them
+	msg := *old
+	msg.Content = content
+	msg.EditedTimestamp = discordgo.Timestamp(strconv.Itoa(a.edits))
+	a.messages[messageID] = &msg
+	copied := msg
+	a.echo(&discordgo.MessageUpdate{Message: &copied})
+	result := msg
+	return &result, nil
+}
+
+func (a *fakeAPI) ChannelMessageDelete(channelID, messageID string) error {
+	a.Lock()
+	defer a.Unlock()
+	a.calls["delete"]++
+	if _, ok := a.messages[messageID]; !ok {
+		return errUnknownMessage
+	}
+	delete(a.messages, messageID)
+	a.echo(&discordgo.MessageDelete{Message: &discordgo.Message{ID: messageID, ChannelID: channelID}})
+	return nil
+}
+
+func (a *fakeAPI) ChannelMessage(channelID, messageID string) (*discordgo.Message, error) {
+	a.Lock()
+	a.calls["message"]++
+	hold := a.hold
+	a.Unlock()
+	if hold != nil {
+		<-hold
+	}
+
+	a.Lock()
+	defer a.Unlock()
+	msg, ok := a.messages[messageID]
+	if !ok {
+		return nil, errUnknownMessage
+	}
+	copied := *msg
+	return &copied, nil
+}
+
+// The limit messages right after afterID, newest first
+func (a *fakeAPI) ChannelMessages(channelID string, limit int, beforeID, afterID string) ([]*discordgo.Message, error) {
+	a.Lock()
+	defer a.Unlock()
+	a.calls["messages"]++
+	after, _ := strconv.ParseUint(afterID, 10, 64)
+	ids := make([]uint64, 0)
+	for id := range a.messages {
+		n, _ := strconv.ParseUint(id, 10, 64)
+		if n > after {
+			ids = append(ids, n)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	if len(ids) > limit {
+		ids = ids[:limit]
+	}
+	msgs := make([]*discordgo.Message, 0, len(ids))
+	for i := len(ids) - 1; i >= 0; i-- {
+		copied := *a.messages[strconv.FormatUint(ids[i], 10)]
+		msgs = append(msgs, &copied)
+	}
+	return msgs, nil
+}
+
+func (a *fakeAPI) ChannelEdit(channelID, name, topic string, position, bitrate, userLimit int) (*discordgo.Channel, error) {
+	a.Lock()
+	defer a.Unlock()
+	a.calls["channel"]++
+	a.topic = topic
+	return &discordgo.Channel{ID: channelID, Name: name, Topic: topic}, nil
+}
+
+func (a *fakeAPI) callCount(method string) int {
+	a.Lock()
+	defer a.Unlock()
+	return a.calls[method]
+}
+
+// Some message, for events from other clients
+func (a *fakeAPI) anyMessage() string {
+	a.Lock()
+	defer a.Unlock()
+	for id := range a.messages {
+		return id
+	}
+	return ""
+}
+
+// Hands the echoed events to the handlers until stop is closed
+func (a *fakeAPI) deliver(fs *DiscordFS, stop chan struct{}) {
+	for {
+		select {
+		case <-stop:
+			return
+		case event := <-a.events:
+			switch e := event.(type) {
+			case *discordgo.MessageUpdate:
+				fs.OnMessageEdit(nil, e)
+			case *discordgo.MessageDelete:
+				fs.OnMessageRemove(nil, e)
+			}
+		}
+	}
+}
+
+// Sets up a fresh filesystem on the fake like Mount does, without the kernel
+func newTestFS(t *testing.T) (*DiscordFS, *Node, *fakeAPI) {
+	log.SetOutput(ioutil.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	api := newFakeAPI()
+	fs := NewFS(&discordgo.Session{}, testGuild, nil)
+	fs.api = api
+
+	err := fs.Initialize(&discordgo.Guild{Channels: []*discordgo.Channel{{ID: testGuild, Name: "fs"}}})
+	if err != nil {
+		t.Fatal("initializing", err)
+	}
+	var header *FileDesc
+	err = json.Unmarshal([]byte(api.topic), &header)
+	if err != nil {
+		t.Fatal("reading topic", err)
+	}
+	rootDesc, err := fs.loadInode(header.InodeNumber())
+	if err != nil {
+		t.Fatal("loading root", err)
+	}
+	err = fs.createJournal(rootDesc)
+	if err != nil {
+		t.Fatal("creating journal", err)
+	}
+	fs.journal = rootDesc.Journal
+	fs.rootIno = rootDesc.InodeNumber()
+	leaseSettle = 0
+	err = fs.takeLease(rootDesc)
+	if err != nil {
+		t.Fatal("taking lease", err)
+	}
+	err = fs.loadSuperblock(rootDesc)
+	if err != nil {
+		t.Fatal("loading superblock", err)
+	}
+
+	root := fs.newNode(rootDesc)
+	fusefs.NewNodeFS(root, &fusefs.Options{})
+	return fs, root, api
+}
+
+func writeFile(t *testing.T, dir *Node, name string, data []byte) *Node {
+	ctx := context.Background()
+	inode, fh, _, code := dir.Create(ctx, name, syscall.O_RDWR, 0644, &fuse.EntryOut{})
+	if code != 0 {
+		t.Fatal("creating", name, code)
+	}
+	h := fh.(*FileHandle)
+	if _, code = h.Write(ctx, data, 0); code != 0 {
+		t.Fatal("writing", name, code)
+	}
+	if code = h.Flush(ctx); code != 0 {
+		t.Fatal("flushing", name, code)
+	}
+	h.Release(ctx)
+	return inode.Operations().(*Node)
+}
+
+func readFile(node *Node) ([]byte, syscall.Errno) {
+	ctx := context.Background()
+	fh, _, code := node.Open(ctx, syscall.O_RDONLY)
+	if code != 0 {
+		return nil, code
+	}
+	h := fh.(*FileHandle)
+	defer h.Release(ctx)
+
+	dest := make([]byte, 4<<20)
+	result, code := h.Read(ctx, dest, 0)
+	if code != 0 {
+		return nil, code
+	}
+	data, _ := result.Bytes(nil)
+	return data, 0
+}
+
+// Every operation at once on different files, and on the same file, while the gateway
+// echoes our changes and other clients edit messages. The files end up as written
+func TestConcurrentOps(t *testing.T) {
+	fs, root, api := newTestFS(t)
+	ctx := context.Background()
+
+	shared := bytes.Repeat([]byte("shared "), 1000)
+	sharedNode := writeFile(t, root, "shared", shared)
+
+	stop := make(chan struct{})
+	var background sync.WaitGroup
+	background.Add(2)
+	go func() {
+		defer background.Done()
+		api.deliver(fs, stop)
+	}()
+	go func() {
+		defer background.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			fs.InvalidateMessage(api.anyMessage())
+			fs.writeUsage(root)
+		}
+	}()
+
+	const workers = 8
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			name := "d" + strconv.Itoa(i)
+			inode, code := root.Mkdir(ctx, name, 0755, &fuse.EntryOut{})
+			if code != 0 {
+				t.Error("mkdir", name, code)
+				return
+			}
+			dir := inode.Operations().(*Node)
+
+			data := bytes.Repeat([]byte{byte('a' + i)}, 5000+i)
+			file := writeFile(t, dir, "a", data)
+
+			// Appended, then renamed out of the directory and linked back in
+			fh, _, code := file.Open(ctx, syscall.O_WRONLY|syscall.O_APPEND)
+			if code != 0 {
+				t.Error("open", name, code)
+				return
+			}
+			h := fh.(*FileHandle)
+			h.Write(ctx, []byte("tail"), 0)
+			if code := h.Flush(ctx); code != 0 {
+				t.Error("append", name, code)
+			}
+			h.Release(ctx)
+			data = append(data, "tail"...)
+
+			if code := file.Setxattr(ctx, "user.name", []byte(name), 0); code != 0 {
+				t.Error("setxattr", name, code)
+			}
+			if code := dir.Rename(ctx, "a", root, "f"+strconv.Itoa(i), 0); code != 0 {
+				t.Error("rename", name, code)
+			}
+			if _, code := dir.Link(ctx, file, "b", &fuse.EntryOut{}); code != 0 {
+				t.Error("link", name, code)
+			}
+			if code := dir.Unlink(ctx, "b"); code != 0 {
+				t.Error("unlink", name, code)
+			}
+
+			if _, code := root.Readdir(ctx); code != 0 {
+				t.Error("readdir", code)
+			}
+			if code := root.Statfs(ctx, &fuse.StatfsOut{}); code != 0 {
+				t.Error("statfs", code)
+			}
+			if code := file.Getattr(ctx, nil, &fuse.AttrOut{}); code != 0 {
+				t.Error("getattr", name, code)
+			}
+
+			read, code := readFile(sharedNode)
+			if code != 0 || !bytes.Equal(read, shared) {
+				t.Error("reading shared file", code, len(read))
+			}
+			read, code = readFile(file)
+			if code != 0 || !bytes.Equal(read, data) {
+				t.Error("reading", name, code, len(read), len(data))
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(stop)
+	background.Wait()
+
+	stream, code := root.Readdir(ctx)
+	if code != 0 {
+		t.Fatal("readdir", code)
+	}
+	names := make(map[string]bool)
+	for stream.HasNext() {
+		entry, _ := stream.Next()
+		names[entry.Name] = true
+	}
+	for i := 0; i < workers; i++ {
+		for _, name := range []string{"d" + strconv.Itoa(i), "f" + strconv.Itoa(i)} {
+			if !names[name] {
+				t.Error("missing", name, "in", names)
+			}
+		}
+		inode, code := root.Lookup(ctx, "f"+strconv.Itoa(i), &fuse.EntryOut{})
+		if code != 0 {
+			t.Error("lookup", i, code)
+			continue
+		}
+		read, _ := readFile(inode.Operations().(*Node))
+		want := append(bytes.Repeat([]byte{byte('a' + i)}, 5000+i), "tail"...)
+		if !bytes.Equal(read, want) {
+			t.Error(fmt.Sprintf("f%d has %d bytes, want %d", i, len(read), len(want)))
+		}
+	}
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"context"
+	fusefs "github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"log"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// FileHandle is an open file. Writes are buffered in the handle and only merged into the
+// shared inode on flush, so other opens of the same file see them once the writer flushes
+type FileHandle struct {
+	node *Node
+
+	lock  sync.Mutex
+	flags uint32        // Flags the file was opened with
+	pos   int64         // Where the last read or write ended, used to merge sequential writes
+	dirty []*dirtyWrite // Writes not yet merged into the inode, in order
+
+	lastWrite time.Time // Becomes the mtime of the file when the writes are merged
+}
+
+var (
+	_ fusefs.FileReader    = (*FileHandle)(nil)
+	_ fusefs.FileWriter    = (*FileHandle)(nil)
+	_ fusefs.FileFlusher   = (*FileHandle)(nil)
+	_ fusefs.FileFsyncer   = (*FileHandle)(nil)
+	_ fusefs.FileReleaser  = (*FileHandle)(nil)
+	_ fusefs.FileAllocater = (*FileHandle)(nil)
+	_ fusefs.FileLseeker   = (*FileHandle)(nil)
+)
+
+type dirtyWrite struct {
+	off  int64
+	data []byte
+}
+
+func (n *Node) newHandle(flags uint32) *FileHandle {
+	return &FileHandle{
+		node:  n,
+		flags: flags,
+	}
+}
+
+func (h *FileHandle) String() string { return "FileHandle(" + h.node.getPath() + ")" }
+
+// Applies the writes on top of data, growing it if they go past the end
+func applyWrites(data []byte, writes []*dirtyWrite) []byte {
+	for _, w := range writes {
+		end := w.off + int64(len(w.data))
+		if end > int64(len(data)) {
+			newBuf := make([]byte, end)
+			copy(newBuf, data)
+			data = newBuf
+		}
+		copy(data[w.off:], w.data)
+	}
+	return data
+}
+
+// Returns what the writes add and where if they only append to a file of size, one after
+// another. They may start past the end, the gap reads as zeros
+func appended(size int64, writes []*dirtyWrite) ([]byte, int64, bool) {
+	start := writes[0].off
+	if start < size {
+		return nil, 0, false
+	}
+	if len(writes) == 1 {
+		return writes[0].data, start, true
+	}
+	data := make([]byte, 0)
+	for _, w := range writes {
+		if w.off != start+int64(len(data)) {
+			return nil, 0, false
+		}
+		data = append(data, w.data...)
+	}
+	return data, start, true
+}
+
+// Returns the bytes in [off, end) as seen through this handle, with its writes on top. Past the
+// stored data they're zeros
+// Caller must hold h.lock
+func (h *FileHandle) readRange(off, end int64) ([]byte, error) {
+	// Cached data and sparse files can be read by many at once, loading the data needs the write lock
+	desc := h.node.desc
+	h.node.lock.RLock()
+	if desc.Cache == nil && !desc.sparse() {
+		h.node.lock.RUnlock()
+		h.node.lock.Lock()
+		defer h.node.lock.Unlock()
+	} else {
+		defer h.node.lock.RUnlock()
+	}
+
+	data := make([]byte, end-off)
+	if stored := int64(desc.Size); off < stored {
+		if stored > end {
+			stored = end
+		}
+		decoded, err := desc.decodedRange(off, stored)
+		if err != nil {
+			return nil, err
+		}
+		copy(data, decoded)
+	}
+
+	for _, w := range h.dirty {
+		from, to := w.off-off, w.off+int64(len(w.data))-off
+		if to <= 0 || from >= int64(len(data)) {
+			continue
+		}
+		if from < 0 {
+			copy(data, w.data[-from:])
+		} else {
+			copy(data[from:], w.data)
+		}
+	}
+	return data, nil
+}
+
+// Returns the size of the file as seen through this handle
+// Caller must hold h.lock
+func (h *FileHandle) size() int64 {
+	h.node.lock.RLock()
+	size := int64(h.node.desc.Size)
+	h.node.lock.RUnlock()
+
+	for _, w := range h.dirty {
+		if end := w.off + int64(len(w.data)); end > size {
+			size = end
+		}
+	}
+	return size
+}
+
+// Nondirectory filedata is encoded in base64 to be on the safe side
+func (h *FileHandle) Read(ctx context.Context, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	log.Println("READ", off, len(dest))
+	size := h.size()
+	if off >= size {
+		// Reading at or past the end of the file
+		return fuse.ReadResultData(nil), fusefs.OK
+	}
+
+	toRead := int64(len(dest))
+	if toRead+off >= size {
+		toRead = size - off
+		log.Println("Bigger than input")
+	}
+
+	data, err := h.readRange(off, off+toRead)
+	if err != nil {
+		log.Println("Failed loading data", err)
+		return nil, syscall.EBADF
+	}
+	copy(dest, data)
+	h.pos = off + toRead
+	h.node.accessed()
+	return fuse.ReadResultData(dest[:toRead]), fusefs.OK
+}
+
+func (h *FileHandle) Write(ctx context.Context, data []byte, off int64) (uint32, syscall.Errno) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	// The offset from the kernel is based on the size it knows of, which may be stale
+	if h.flags&syscall.O_APPEND != 0 {
+		off = h.size()
+	}
+	log.Println("WRITE", len(data), off)
+	if end := off + int64(len(data)); end > h.size() {
+		if code := h.node.checkSize(end); code != fuse.OK {
+			return 0, errno(code)
+		}
+	}
+	h.lastWrite = time.Now()
+
+	// Sequential writes go into one buffer
+	if len(h.dirty) > 0 && off == h.pos {
+		last := h.dirty[len(h.dirty)-1]
+		if last.off+int64(len(last.data)) == off {
+			last.data = append(last.data, data...)
+			h.pos = off + int64(len(data))
+			return uint32(len(data)), fusefs.OK
+		}
+	}
+
+	buf := make([]byte, len(data))
+	copy(buf, data)
+	h.dirty = append(h.dirty, &dirtyWrite{off: off, data: buf})
+	h.pos = off + int64(len(data))
+	return uint32(len(data)), fusefs.OK
+}
+
+// Merges the writes of this handle into the inode
+// Caller must hold h.lock and h.node.lock
+func (h *FileHandle) mergeLocked() fuse.Status {
+	if len(h.dirty) < 1 {
+		return fuse.OK
+	}
+
+	if data, off, ok := appended(int64(h.node.desc.Size), h.dirty); ok {
+		// Logs and the like, only the new bytes are encoded. A gap before them becomes holes
+		if off > int64(h.node.desc.Size) {
+			code := h.node.desc.grow(int(off))
+			if code != fuse.OK {
+				return code
+			}
+		}
+		err := h.node.desc.appendData(data)
+		if err != nil {
+			log.Println("Failed appending data", err)
+			return fuse.EIO
+		}
+	} else {
+		decoded, err := h.node.desc.decodedData()
+		if err != nil {
+			log.Println("Failed loading data", err)
+			return fuse.EIO
+		}
+		h.node.desc.setDecodedData(applyWrites(decoded, h.dirty))
+	}
+	h.node.desc.touch(h.lastWrite)
+	h.dirty = nil
+	return fuse.OK
+}
+
+// Flush is called for close() call on a file descriptor. In
+// case of duplicated descriptor, it may be called more than
+// once for a file.
+func (h *FileHandle) Flush(ctx context.Context) syscall.Errno {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.node.lock.Lock()
+	code := h.mergeLocked()
+	h.node.lock.Unlock()
+	if code != fuse.OK {
+		return errno(code)
+	}
+	return errno(h.node.flush())
+}
+
+func (h *FileHandle) Fsync(ctx context.Context, flags uint32) syscall.Errno {
+	return h.Flush(ctx)
+}
+
+// This is called to before the file handle is forgotten. Anything
+// still dirty here was never flushed, which the kernel doesn't do
+func (h *FileHandle) Release(ctx context.Context) syscall.Errno {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if len(h.dirty) > 0 {
+		log.Println("Releasing handle with unflushed writes", h.node.getPath())
+	}
+	h.dirty = nil
+	return fusefs.OK
+}
+
+func (h *FileHandle) Truncate(size uint64) fuse.Status {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.node.lock.Lock()
+	defer h.node.lock.Unlock()
+
+	// Writes made before the truncate must not reappear after it
+	code := h.mergeLocked()
+	if code != fuse.OK {
+		return code
+	}
+	return h.node.desc.Truncate(size)
+}
+
+func (h *FileHandle) GetAttr(out *fuse.Attr) fuse.Status {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.node.lock.RLock()
+	code := h.node.desc.GetAttr(out)
+	h.node.lock.RUnlock()
+
+	out.Size = uint64(h.size())
+	return code
+}
+
+func (h *FileHandle) Allocate(ctx context.Context, off uint64, size uint64, mode uint32) syscall.Errno {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if mode == 0 {
+		if code := h.node.checkSize(int64(off + size)); code != fuse.OK {
+			return errno(code)
+		}
+	}
+
+	h.node.lock.Lock()
+	defer h.node.lock.Unlock()
+
+	// Like truncate the range applies on top of the writes made before
+	code := h.mergeLocked()
+	if code != fuse.OK {
+		return errno(code)
+	}
+	return errno(h.node.desc.Allocate(off, size, mode))
+}
+
+// SEEK_DATA and SEEK_HOLE, the kernel deals with the others
+func (h *FileHandle) Lseek(ctx context.Context, off uint64, whence uint32) (uint64, syscall.Errno) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if whence != seekData && whence != seekHole {
+		return 0, syscall.EINVAL
+	}
+
+	if len(h.dirty) > 0 {
+		// Not merged yet, everything up to the end is data
+		size := uint64(h.size())
+		if off >= size {
+			return 0, syscall.ENXIO
+		}
+		if whence == seekData {
+			return off, fusefs.OK
+		}
+		return size, fusefs.OK
+	}
+
+	h.node.lock.RLock()
+	defer h.node.lock.RUnlock()
+	pos, code := h.node.desc.seek(int64(off), int(whence))
+	return uint64(pos), errno(code)
+}
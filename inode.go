@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/jonas747/discordgo"
+	"log"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// The inode table. Every inode is stored in its handle message, the message id is the inode
+// number. Directories only map names to inode numbers, so a file can have more than one name
+//
+// The handle message holds either "i" followed by the inode, or for inodes too large for one
+// message "t" followed by a list of the record messages that together hold the inode
+
+// Owner chunk of messages that aren't file data, see messageOwner
+const (
+	ownerDirData = -1
+	ownerInode   = -2
+)
+
+const (
+	inodeRecordPrefix = "i"
+	inodeTablePrefix  = "t"
+)
+
+var (
+	ErrNoInode       = errors.New("Message is not an inode")
+	ErrInodeTooLarge = errors.New("Inode is too large for the inode table")
+)
+
+// DirEntry is a name in a directory
+type DirEntry struct {
+	Name string `json:"name"`
+	Ino  uint64 `json:"ino"`
+	Type uint32 `json:"type,omitempty"` // File type bits of the inode, so readdir doesn't need the inode
+
+	// Entries written before the inode table embed the whole inode
+	legacy *FileDesc
+}
+
+func newDirEntry(name string, desc *FileDesc) *DirEntry {
+	return &DirEntry{
+		Name: name,
+		Ino:  desc.InodeNumber(),
+		Type: desc.FileMode() & syscall.S_IFMT,
+	}
+}
+
+func inodeMessageID(ino uint64) string {
+	return strconv.FormatUint(ino, 10)
+}
+
+// Cuts data into message sized parts, there's always at least one
+func splitParts(data []byte) [][]byte {
+	parts := make([][]byte, 0, len(data)/BYTES_PER_MSG+1)
+	for i := 0; i == 0 || i*BYTES_PER_MSG < len(data); i++ {
+		end := (i + 1) * BYTES_PER_MSG
+		if end > len(data) {
+			end = len(data)
+		}
+		parts = append(parts, data[i*BYTES_PER_MSG:end])
+	}
+	return parts
+}
+
+// Writes parts to the messages in old, only editing the ones whose content changed. More messages
+// are sent if there are more parts and the ones left over are deleted. Returns the messages now
+// holding the parts
+func (fs *DiscordFS) writeParts(channel string, parts [][]byte, old []*Chunk) ([]*Chunk, error) {
+	written := make([]*Chunk, 0, len(parts))
+	for i, part := range parts {
+		var msg *discordgo.Message
+		var err error
+		if i < len(old) {
+			if cached, ok := fs.chunks.Get(old[i].ID, old[i].Edited); ok && bytes.Equal(cached, part) {
+				written = append(written, old[i])
+				continue
+			}
+			msg, err = fs.editMessage(channel, old[i].ID, "f"+string(part))
+		} else {
+			msg, err = fs.sendMessage(channel, "f"+string(part))
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		fs.chunks.Put(msg.ID, string(msg.EditedTimestamp), part)
+		written = append(written, &Chunk{ID: msg.ID, Edited: string(msg.EditedTimestamp)})
+	}
+
+	for i := len(written); i < len(old); i++ {
+		err := fs.deleteMessage(channel, old[i].ID)
+		if err != nil {
+			log.Println("Failed freeing message", err)
+		}
+	}
+	return written, nil
+}
+
+// Fetches an inode from the inode table
+func (fs *DiscordFS) loadInode(ino uint64) (*FileDesc, error) {
+	id := inodeMessageID(ino)
+	msg, err := fs.fetchMessage(fs.Guild, id)
+	if err != nil {
+		return nil, err
+	}
+
+	content := msg.Content
+	var records []*Chunk
+	if strings.HasPrefix(content, inodeTablePrefix) {
+		var ids []string
+		err = json.Unmarshal([]byte(content[1:]), &ids)
+		if err != nil {
+			return nil, err
+		}
+
+		encoded := make([]byte, 0)
+		for _, recordID := range ids {
+			record, err := fs.fetchMessage(fs.Guild, recordID)
+			if err != nil {
+				return nil, err
+			}
+			part := []byte{}
+			if len(record.Content) > 0 {
+				part = []byte(record.Content[1:])
+			}
+			encoded = append(encoded, part...)
+			fs.chunks.Put(record.ID, string(record.EditedTimestamp), part)
+			records = append(records, &Chunk{ID: record.ID, Edited: string(record.EditedTimestamp)})
+		}
+		content = inodeRecordPrefix + string(encoded)
+	}
+	if !strings.HasPrefix(content, inodeRecordPrefix) {
+		return nil, ErrNoInode
+	}
+
+	var desc *FileDesc
+	err = json.Unmarshal([]byte(content[1:]), &desc)
+	if err != nil {
+		return nil, err
+	}
+	desc.FS = fs
+	desc.Ino = ino
+	desc.records = records
+	desc.storedSize = desc.Size
+
+	fs.setOwner(id, ino, ownerInode)
+	for _, record := range records {
+		fs.setOwner(record.ID, ino, ownerInode)
+	}
+	desc.registerChunks()
+	return desc, nil
+}
+
+// Writes the inode to the inode table
+func (f *FileDesc) WriteInode() error {
+	if super := f.FS.superblock(); f.IsRoot && super != nil {
+		f.Super = super
+	}
+	if quota := f.FS.quota(f.InodeNumber()); quota != nil {
+		f.Quota = quota
+	}
+
+	encoded, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+
+	var parts [][]byte
+	if len(encoded) > BYTES_PER_MSG {
+		parts = splitParts(encoded)
+		// Every id takes up at most 23 characters in the list
+		if len(parts)*23+2 > BYTES_PER_MSG {
+			return ErrInodeTooLarge
+		}
+	}
+
+	// Drops the record messages if the inode fits in the handle again
+	records, err := f.FS.writeParts(f.FS.Guild, parts, f.records)
+	if err != nil {
+		return err
+	}
+	f.records = records
+
+	content := inodeRecordPrefix + string(encoded)
+	if len(records) > 0 {
+		ids := make([]string, len(records))
+		for i, record := range records {
+			ids[i] = record.ID
+			f.FS.setOwner(record.ID, f.InodeNumber(), ownerInode)
+		}
+		encodedIDs, _ := json.Marshal(ids)
+		content = inodeTablePrefix + string(encodedIDs)
+	}
+
+	id := inodeMessageID(f.InodeNumber())
+	_, err = f.FS.editMessage(f.FS.Guild, id, content)
+	if err != nil {
+		return err
+	}
+	f.FS.setOwner(id, f.InodeNumber(), ownerInode)
+	f.releaseGarbage()
+
+	f.FS.addUsage(0, int64(f.Size-f.storedSize), 0)
+	if node := f.FS.getNode(f.InodeNumber()); node != nil {
+		f.FS.charge(node.quotaDirs(), 0, int64(f.Size-f.storedSize))
+	}
+	f.storedSize = f.Size
+	return nil
+}
+
+// Releases the chunks the inode used before, packed chunks leave their pack
+func (f *FileDesc) releaseGarbage() {
+	for _, chunk := range f.garbage {
+		if chunk.Len > 0 {
+			f.FS.unpack(chunk, f.InodeNumber())
+		} else {
+			f.FS.releaseChunk(f.DataChannelID, chunk)
+		}
+	}
+	f.garbage = nil
+}
+
+// Deletes the messages of an inode that has no names left
+func (fs *DiscordFS) freeInode(f *FileDesc) {
+	log.Println("Freeing inode", f.InodeNumber())
+
+	if f.Chunks == nil && f.DataMsgCount > 0 {
+		err := f.loadLegacyChunks()
+		if err != nil {
+			log.Println("Failed loading chunks to free", err)
+		}
+	}
+
+	f.garbage = append(f.garbage, f.Chunks...)
+	f.releaseGarbage()
+	fs.freeMessages(f.DataChannelID, f.xattrMessages())
+
+	fs.freeMessages(fs.Guild, append(chunkIDs(f.records), inodeMessageID(f.InodeNumber())))
+	fs.addUsage(-1, -int64(f.storedSize), 0)
+	fs.dropQuota(f.InodeNumber())
+}
+
+// Returns true if the directory of the entry has no entries
+func (fs *DiscordFS) dirEmpty(entry *DirEntry) (bool, error) {
+	if node := fs.getNode(entry.Ino); node != nil {
+		node.lock.Lock()
+		defer node.lock.Unlock()
+		entries, err := node.desc.GetDirEntries()
+		return len(entries) == 0, err
+	}
+
+	desc := entry.legacy
+	if desc == nil {
+		var err error
+		desc, err = fs.loadInode(entry.Ino)
+		if err != nil {
+			return false, err
+		}
+	}
+	entries, err := desc.GetDirEntries()
+	return len(entries) == 0, err
+}
+
+// Removes a name of the inode, freeing it when it was the last one. Inodes still known to the
+// kernel are freed once it forgets them, they may still be open. The usage is taken off the
+// quotas the name was in once there are no names left
+func (fs *DiscordFS) dropLink(entry *DirEntry, quotas []uint64) {
+	if node := fs.getNode(entry.Ino); node != nil {
+		node.lock.Lock()
+		node.desc.unlink()
+		unlinked, size := node.desc.unlinked, node.desc.storedSize
+		node.lock.Unlock()
+		if unlinked {
+			fs.charge(quotas, -1, -int64(size))
+		}
+		node.syncInode()
+		return
+	}
+
+	desc := entry.legacy
+	if desc == nil {
+		var err error
+		desc, err = fs.loadInode(entry.Ino)
+		if err != nil {
+			log.Println("Failed loading unlinked inode", entry.Ino, err)
+			return
+		}
+	}
+
+	desc.unlink()
+	if desc.unlinked {
+		fs.charge(quotas, -1, -int64(desc.storedSize))
+		fs.freeInode(desc)
+		return
+	}
+	err := desc.WriteInode()
+	if err != nil {
+		log.Println("Failed writing unlinked inode", entry.Ino, err)
+	}
+}
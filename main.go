@@ -4,21 +4,92 @@ import (
 	"flag"
 	"github.com/jonas747/discordgo"
 	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+var (
+	flagCacheDir  = flag.String("cachedir", filepath.Join(os.Getenv("HOME"), ".cache", "discord-fs"), "Directory for the persistent chunk cache, empty to disable")
+	flagCacheSize = flag.Int64("cachesize", 512, "Max size of the chunk cache in megabytes")
+
+	// Remote changes are pushed to the kernel as they come in over the gateway,
+	// so these only matter if events are missed
+	flagEntryTimeout    = flag.Duration("entrytimeout", 10*time.Second, "How long the kernel may cache directory entries")
+	flagAttrTimeout     = flag.Duration("attrtimeout", 10*time.Second, "How long the kernel may cache file attributes")
+	flagNegativeTimeout = flag.Duration("negativetimeout", time.Second, "How long the kernel may cache lookups of files that don't exist")
+
+	// Every access time update is a write to discord, so they're off unless asked for
+	flagAtime = flag.String("atime", "noatime", "Access time updates, noatime or relatime")
+
+	// Permissions are checked by the kernel against the stored modes, unless ignored
+	flagIgnorePerms = flag.Bool("ignoreperms", false, "Don't check permissions, anyone with access to the mount can do anything")
+	flagUid         = flag.Int("uid", -1, "Show all files as owned by this uid, -1 to use the stored owner")
+	flagGid         = flag.Int("gid", -1, "Show all files as owned by this gid, -1 to use the stored group")
+	flagUmask       = flag.String("umask", "", "Octal mask of permission bits to hide from all files, on top of the stored modes")
+
+	// What df shows, see superblock.go
+	flagCapacity = flag.Int64("capacity", 1000000, "Size of the filesystem shown by df in megabytes, discord has no limit")
+	flagChunking = flag.String("chunking", "fixed", "How file data is cut into messages, fixed or cdc (content defined, edits rewrite less)")
+	flagRecount  = flag.Bool("recount", false, "Count the usage shown by df and the chunk references again, done anyway after a crash")
+	flagForce    = flag.Bool("force", false, "Mount even while another mount holds the lease, for when it died without unmounting")
+
+	// Parsed from -umask
+	mountUmask uint32
 )
 
 func main() {
 	flag.Parse()
-	if len(flag.Args()) < 3 {
-		log.Fatal("Usage:\n  discord-fs TOKEN GUILDID MOUNTPOINT")
+	args := flag.Args()
+	command := ""
+	if len(args) > 0 && args[0] == "usage" {
+		command, args = args[0], args[1:]
+	}
+	if len(args) < 3 && command == "" || len(args) < 2 {
+		log.Fatal("Usage:\n  discord-fs [flags] TOKEN GUILDID MOUNTPOINT\n  discord-fs usage TOKEN GUILDID [PATH]")
 	}
 	log.SetFlags(log.Lmicroseconds)
 
+	if *flagUmask != "" {
+		umask, err := strconv.ParseUint(*flagUmask, 8, 32)
+		if err != nil || umask&^0777 != 0 {
+			log.Fatal("Invalid umask ", *flagUmask)
+		}
+		mountUmask = uint32(umask)
+	}
+
+	if *flagChunking != "fixed" && *flagChunking != "cdc" {
+		log.Fatal("Invalid chunking ", *flagChunking)
+	}
+
 	log.Println("Starting discord-fs")
-	session, err := discordgo.New(flag.Arg(0))
+	session, err := discordgo.New(args[0])
 	if err != nil {
 		panic(err)
 	}
-	NewFS(session, flag.Arg(1))
+
+	var chunkCache *ChunkCache
+	if *flagCacheDir != "" {
+		chunkCache, err = NewChunkCache(*flagCacheDir, *flagCacheSize*1000000)
+		if err != nil {
+			log.Println("Failed setting up chunk cache, continuing without", err)
+		}
+	}
+	dfs := NewFS(session, args[1], chunkCache)
+	if command == "usage" {
+		path := ""
+		if len(args) > 2 {
+			path = args[2]
+		}
+		dfs.Command = func() {
+			err := dfs.printUsage(path)
+			if err != nil {
+				log.Fatal("Failed getting usage ", err)
+			}
+			os.Exit(0)
+		}
+	}
 
 	err = session.Open()
 	if err != nil {
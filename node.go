@@ -0,0 +1,731 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	fusefs "github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"log"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Node is the in memory inode of a file or directory. The kernel holds on to nodes
+// it has looked up, so operations work on the inode directly instead of resolving paths.
+// There's one node per inode, a file with more than one link is in more than one directory
+//
+// Locking: lock protects desc (including its cache). A directory's lock also protects
+// its entries, so namespace changes lock the directory. When holding more than one lock,
+// always lock the directory before the inodes in it
+type Node struct {
+	fusefs.Inode
+	fs  *DiscordFS
+	ino uint64 // Never changes, can be read without the lock
+
+	lock sync.RWMutex
+	desc *FileDesc
+}
+
+// The fs package skips operations whose signature doesn't match, these make sure they do
+var (
+	_ fusefs.NodeLookuper      = (*Node)(nil)
+	_ fusefs.NodeGetattrer     = (*Node)(nil)
+	_ fusefs.NodeSetattrer     = (*Node)(nil)
+	_ fusefs.NodeReaddirer     = (*Node)(nil)
+	_ fusefs.NodeOpener        = (*Node)(nil)
+	_ fusefs.NodeCreater       = (*Node)(nil)
+	_ fusefs.NodeMkdirer       = (*Node)(nil)
+	_ fusefs.NodeSymlinker     = (*Node)(nil)
+	_ fusefs.NodeMknoder       = (*Node)(nil)
+	_ fusefs.NodeReadlinker    = (*Node)(nil)
+	_ fusefs.NodeRmdirer       = (*Node)(nil)
+	_ fusefs.NodeUnlinker      = (*Node)(nil)
+	_ fusefs.NodeLinker        = (*Node)(nil)
+	_ fusefs.NodeRenamer       = (*Node)(nil)
+	_ fusefs.NodeStatfser      = (*Node)(nil)
+	_ fusefs.NodeGetxattrer    = (*Node)(nil)
+	_ fusefs.NodeSetxattrer    = (*Node)(nil)
+	_ fusefs.NodeRemovexattrer = (*Node)(nil)
+	_ fusefs.NodeListxattrer   = (*Node)(nil)
+	_ fusefs.NodeOnForgetter   = (*Node)(nil)
+)
+
+func (fs *DiscordFS) newNode(desc *FileDesc) *Node {
+	desc.FS = fs
+	n := &Node{
+		fs:   fs,
+		ino:  desc.InodeNumber(),
+		desc: desc,
+	}
+
+	fs.nodeLock.Lock()
+	fs.nodes[desc.InodeNumber()] = n
+	fs.nodeLock.Unlock()
+
+	if desc.Quota != nil {
+		fs.registerQuota(n.ino, desc.Quota)
+	}
+	return n
+}
+
+// The fs package wants errnos, statuses are errnos already
+func errno(code fuse.Status) syscall.Errno {
+	return syscall.Errno(code)
+}
+
+// The owner of new files
+func callerOwner(ctx context.Context) fuse.Owner {
+	if caller, ok := fuse.FromContext(ctx); ok {
+		return caller.Owner
+	}
+	return fuse.Owner{}
+}
+
+func (fs *DiscordFS) getNode(ino uint64) *Node {
+	fs.nodeLock.Lock()
+	defer fs.nodeLock.Unlock()
+	return fs.nodes[ino]
+}
+
+func (n *Node) OnForget() {
+	n.lock.RLock()
+	unlinked := n.desc.unlinked
+	n.lock.RUnlock()
+
+	n.fs.nodeLock.Lock()
+	if n.fs.nodes[n.ino] == n {
+		delete(n.fs.nodes, n.ino)
+	}
+	n.fs.nodeLock.Unlock()
+
+	if unlinked {
+		go n.fs.freeInode(n.desc)
+	}
+}
+
+// Returns the node of a directory entry, loading the inode if the kernel doesn't know about it yet.
+// The fs package adds it to the tree under the name once the operation returns
+// Caller must hold n.lock
+func (n *Node) child(ctx context.Context, entry *DirEntry) (*Node, error) {
+	if existing := n.GetChild(entry.Name); existing != nil {
+		if child, ok := existing.Operations().(*Node); ok && child.ino == entry.Ino {
+			return child, nil
+		}
+	}
+
+	// Another name of the same inode
+	if child := n.fs.getNode(entry.Ino); child != nil {
+		return child, nil
+	}
+
+	desc := entry.legacy
+	if desc == nil {
+		var err error
+		desc, err = n.fs.loadInode(entry.Ino)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return n.newNodeInode(ctx, desc), nil
+}
+
+// Makes the node of desc known to the fs package
+func (n *Node) newNodeInode(ctx context.Context, desc *FileDesc) *Node {
+	child := n.fs.newNode(desc)
+	n.NewInode(ctx, child, fusefs.StableAttr{Mode: desc.FileMode() & syscall.S_IFMT, Ino: child.ino})
+	return child
+}
+
+// Creates the node of a new inode and writes it to the inode table
+// Caller must hold n.lock
+func (n *Node) newChild(ctx context.Context, desc *FileDesc) (*Node, error) {
+	err := desc.WriteInode()
+	if err != nil {
+		return nil, err
+	}
+	child := n.newNodeInode(ctx, desc)
+	n.fs.addUsage(1, 0, 0)
+	n.fs.charge(n.childQuotaDirs(), 1, int64(desc.Size))
+	return child, nil
+}
+
+// The path of the node, only for logging. Nothing stores paths, they're made up from the names
+// the kernel looked the node up by, so a file with more than one link gets one of them
+func (n *Node) getPath() string {
+	return n.Path(nil)
+}
+
+func (n *Node) childPath(name string) string {
+	return strings.Trim(n.getPath()+"/"+name, "/")
+}
+
+// Writes the inode to the inode table if it changed
+// Must be called without holding n.lock
+func (n *Node) syncInode() fuse.Status {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return n.syncInodeLocked()
+}
+
+// Caller must hold n.lock
+func (n *Node) syncInodeLocked() fuse.Status {
+	// Unflushed data doesn't match the chunks yet, the inode is written once it's flushed
+	if !n.desc.InodeDirty || n.desc.Dirty || n.desc.unlinked {
+		return fuse.OK
+	}
+
+	err := n.desc.WriteInode()
+	if err != nil {
+		log.Println("Failed writing inode", n.getPath(), err)
+		return fuse.EIO
+	}
+	n.desc.InodeDirty = false
+	return fuse.OK
+}
+
+// Runs fn on the entries of the directory while holding its lock, and writes them back if fn succeeds
+// fn returns nil entries with fuse.OK if it didn't change anything
+func (n *Node) updateDir(fn func(entries []*DirEntry) ([]*DirEntry, fuse.Status)) fuse.Status {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	entries, err := n.desc.GetDirEntries()
+	if err != nil {
+		log.Println("Failed getting entries", err)
+		return fuse.EIO
+	}
+
+	entries, code := fn(entries)
+	if code != fuse.OK || entries == nil {
+		return code
+	}
+	return n.writeEntries(entries)
+}
+
+// Writes the entries of the directory, and the inode if that moved the data
+// Caller must hold n.lock
+func (n *Node) writeEntries(entries []*DirEntry) fuse.Status {
+	serialized, err := json.Marshal(entries)
+	if err != nil {
+		log.Println("Failed serializing entries", err)
+		return fuse.EIO
+	}
+	n.desc.Cache = serialized
+	code := n.desc.Flush()
+	if code != fuse.OK {
+		// Fetch what's actually stored next time
+		n.desc.Cache = nil
+		return code
+	}
+	return n.syncInodeLocked()
+}
+
+// Flushes the data of the node and writes the inode if that changed it
+func (n *Node) flush() fuse.Status {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	code := n.desc.Flush()
+	if code != fuse.OK {
+		return code
+	}
+	return n.syncInodeLocked()
+}
+
+func (n *Node) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fusefs.Inode, syscall.Errno) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	log.Println("LOOKUP", n.getPath(), name)
+	entry, err := n.desc.GetChild(name)
+	if err != nil {
+		if err == ErrFileNotFound {
+			return nil, syscall.ENOENT
+		}
+		log.Println("Failed looking up child", err)
+		return nil, syscall.EIO
+	}
+
+	child, err := n.child(ctx, entry)
+	if err != nil {
+		log.Println("Failed loading inode", entry.Ino, err)
+		return nil, syscall.EIO
+	}
+	child.lock.RLock()
+	child.desc.GetAttr(&out.Attr)
+	child.lock.RUnlock()
+	return child.EmbeddedInode(), fusefs.OK
+}
+
+func (n *Node) Getattr(ctx context.Context, file fusefs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	// Unflushed writes of the handle count towards the size
+	if h, ok := file.(*FileHandle); ok {
+		return errno(h.GetAttr(&out.Attr))
+	}
+
+	n.lock.RLock()
+	defer n.lock.RUnlock()
+
+	log.Println("GETATTR", n.getPath())
+	return errno(n.desc.GetAttr(&out.Attr))
+}
+
+// Truncates, changes the mode, owner and times, whatever the kernel asks for
+func (n *Node) Setattr(ctx context.Context, file fusefs.FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
+	h, _ := file.(*FileHandle)
+	code := fuse.OK
+	if size, ok := in.GetSize(); ok {
+		code = n.Truncate(h, size)
+	}
+	if mode, ok := in.GetMode(); ok && code == fuse.OK {
+		code = n.Chmod(mode)
+	}
+	uid, uok := in.GetUID()
+	gid, gok := in.GetGID()
+	if (uok || gok) && code == fuse.OK {
+		if !uok {
+			uid = ^uint32(0)
+		}
+		if !gok {
+			gid = ^uint32(0)
+		}
+		code = n.Chown(uid, gid)
+	}
+	atime, aok := in.GetATime()
+	mtime, mok := in.GetMTime()
+	if (aok || mok) && code == fuse.OK {
+		var a, m *time.Time
+		if aok {
+			a = &atime
+		}
+		if mok {
+			m = &mtime
+		}
+		code = n.Utimens(h, a, m)
+	}
+	if code != fuse.OK {
+		return errno(code)
+	}
+	return n.Getattr(ctx, file, out)
+}
+
+func (n *Node) Readdir(ctx context.Context) (fusefs.DirStream, syscall.Errno) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	log.Println("OPENDIR", n.getPath())
+	dir, err := n.desc.GetDirEntries()
+	if err != nil {
+		log.Println("Failed getting dir entries", err)
+		return nil, syscall.EIO
+	}
+
+	c := make([]fuse.DirEntry, 0, len(dir))
+	for _, entry := range dir {
+		c = append(c, fuse.DirEntry{
+			Mode: entry.Type,
+			Name: entry.Name,
+			Ino:  entry.Ino,
+		})
+	}
+	return fusefs.NewListDirStream(c), fusefs.OK
+}
+
+func (n *Node) Open(ctx context.Context, flags uint32) (fusefs.FileHandle, uint32, syscall.Errno) {
+	log.Println("OPEN", n.getPath(), flags)
+	if flags&syscall.O_TRUNC != 0 {
+		n.lock.Lock()
+		code := n.desc.Truncate(0)
+		n.lock.Unlock()
+		if code != fuse.OK {
+			return nil, 0, errno(code)
+		}
+	}
+	return n.newHandle(flags), 0, fusefs.OK
+}
+
+func (n *Node) Truncate(h *FileHandle, size uint64) fuse.Status {
+	if h != nil {
+		return h.Truncate(size)
+	}
+
+	n.lock.Lock()
+	code := n.desc.Truncate(size)
+	n.lock.Unlock()
+	if code != fuse.OK {
+		return code
+	}
+
+	// Truncated by path, there's no open file that will flush it
+	return n.flush()
+}
+
+func (n *Node) Create(ctx context.Context, name string, flags uint32, mode uint32, out *fuse.EntryOut) (*fusefs.Inode, fusefs.FileHandle, uint32, syscall.Errno) {
+	childNode, code := n.create(ctx, name, flags, mode)
+	if code != fuse.OK {
+		return nil, nil, 0, errno(code)
+	}
+	return childNode.entryOut(out), childNode.newHandle(flags), 0, fusefs.OK
+}
+
+func (n *Node) create(ctx context.Context, name string, flags uint32, mode uint32) (*Node, fuse.Status) {
+	var childNode *Node
+	code := n.updateDir(func(entries []*DirEntry) ([]*DirEntry, fuse.Status) {
+		path := n.childPath(name)
+		log.Println("CREATE", path, flags, mode)
+
+		for _, entry := range entries {
+			if entry.Name == name {
+				if flags&syscall.O_EXCL != 0 {
+					return nil, fuse.Status(syscall.EEXIST)
+				}
+				if entry.Type == syscall.S_IFDIR {
+					return nil, fuse.Status(syscall.EISDIR)
+				}
+				var err error
+				childNode, err = n.child(ctx, entry)
+				if err != nil {
+					log.Println("Failed loading inode", entry.Ino, err)
+					return nil, fuse.EIO
+				}
+				return nil, fuse.OK
+			}
+		}
+		if code := n.fs.checkQuota(n.childQuotaDirs(), 1, 0); code != fuse.OK {
+			return nil, code
+		}
+
+		// New files start out inline, the handle is all there is until they grow
+		handle, err := n.fs.allocateHandle(path)
+		if err != nil {
+			log.Println("Failed allocating handle", err)
+			return nil, fuse.EIO
+		}
+
+		fileDesc := &FileDesc{
+			FS:            n.fs,
+			Ino:           snowflakeIno(handle),
+			DataStart:     handle,
+			DataChannelID: n.fs.Guild,
+			Inline:        true,
+		}
+		n.desc.initChild(fileDesc, mode, callerOwner(ctx))
+
+		childNode, err = n.newChild(ctx, fileDesc)
+		if err != nil {
+			log.Println("Failed writing inode", err)
+			return nil, fuse.EIO
+		}
+		n.desc.touch(time.Now())
+		return append(entries, newDirEntry(name, fileDesc)), fuse.OK
+	})
+	if code != fuse.OK {
+		return nil, code
+	}
+
+	// Opened an existing file
+	if flags&syscall.O_TRUNC != 0 {
+		childNode.lock.Lock()
+		code = childNode.desc.Truncate(0)
+		childNode.lock.Unlock()
+		if code != fuse.OK {
+			return nil, code
+		}
+	}
+	return childNode, fuse.OK
+}
+
+func (n *Node) Mkdir(ctx context.Context, name string, mode uint32, out *fuse.EntryOut) (*fusefs.Inode, syscall.Errno) {
+	var childNode *Node
+	code := n.updateDir(func(entries []*DirEntry) ([]*DirEntry, fuse.Status) {
+		path := n.childPath(name)
+		log.Println("MKDIR", path, mode)
+
+		for _, entry := range entries {
+			if entry.Name == name {
+				return nil, fuse.Status(syscall.EEXIST)
+			}
+		}
+		if code := n.fs.checkQuota(n.childQuotaDirs(), 1, 0); code != fuse.OK {
+			return nil, code
+		}
+
+		// Entries are only sent once there are some
+		handle, err := n.fs.allocateHandle(path)
+		if err != nil {
+			log.Println("Failed allocating handle", err)
+			return nil, fuse.EIO
+		}
+
+		desc := &FileDesc{
+			FS:            n.fs,
+			IsDir:         true,
+			Ino:           snowflakeIno(handle),
+			DataStart:     handle,
+			DataChannelID: n.fs.Guild,
+		}
+		n.desc.initChild(desc, mode, callerOwner(ctx))
+
+		childNode, err = n.newChild(ctx, desc)
+		if err != nil {
+			log.Println("Failed writing inode", err)
+			return nil, fuse.EIO
+		}
+		n.desc.touch(time.Now())
+		return append(entries, newDirEntry(name, desc)), fuse.OK
+	})
+	if code != fuse.OK {
+		return nil, errno(code)
+	}
+	return childNode.entryOut(out), fusefs.OK
+}
+
+func (n *Node) Symlink(ctx context.Context, target, name string, out *fuse.EntryOut) (*fusefs.Inode, syscall.Errno) {
+	log.Println("SYMLINK", n.childPath(name), target)
+	childNode, code := n.createSpecial(ctx, name, syscall.S_IFLNK|0777, func(desc *FileDesc) {
+		desc.IsLink = true
+		desc.Size = len(target)
+		desc.Target = target
+	})
+	if code != fuse.OK {
+		return nil, errno(code)
+	}
+	return childNode.entryOut(out), fusefs.OK
+}
+
+func (n *Node) Mknod(ctx context.Context, name string, mode uint32, dev uint32, out *fuse.EntryOut) (*fusefs.Inode, syscall.Errno) {
+	log.Println("MKNOD", n.childPath(name), mode, dev)
+	var childNode *Node
+	code := fuse.OK
+	switch mode & syscall.S_IFMT {
+	case syscall.S_IFIFO, syscall.S_IFSOCK, syscall.S_IFCHR, syscall.S_IFBLK:
+		// Special files are only metadata, the kernel deals with opening them
+		childNode, code = n.createSpecial(ctx, name, mode, func(desc *FileDesc) {
+			desc.Rdev = dev
+		})
+	case 0, syscall.S_IFREG:
+		childNode, code = n.create(ctx, name, syscall.O_EXCL, mode)
+	default:
+		return nil, syscall.EINVAL
+	}
+	if code != fuse.OK {
+		return nil, errno(code)
+	}
+	return childNode.entryOut(out), fusefs.OK
+}
+
+// Fills in the attributes of a new entry
+func (n *Node) entryOut(out *fuse.EntryOut) *fusefs.Inode {
+	n.lock.RLock()
+	n.desc.GetAttr(&out.Attr)
+	n.lock.RUnlock()
+	return n.EmbeddedInode()
+}
+
+// Creates an inode without data, only the handle holding the inode is sent. mode includes the file type
+func (n *Node) createSpecial(ctx context.Context, name string, mode uint32, fill func(desc *FileDesc)) (*Node, fuse.Status) {
+	var childNode *Node
+	code := n.updateDir(func(entries []*DirEntry) ([]*DirEntry, fuse.Status) {
+		path := n.childPath(name)
+		for _, entry := range entries {
+			if entry.Name == name {
+				return nil, fuse.Status(syscall.EEXIST)
+			}
+		}
+		if code := n.fs.checkQuota(n.childQuotaDirs(), 1, 0); code != fuse.OK {
+			return nil, code
+		}
+
+		handle, err := n.fs.allocateHandle(path)
+		if err != nil {
+			log.Println("Failed allocating handle", err)
+			return nil, fuse.EIO
+		}
+
+		desc := &FileDesc{
+			FS:            n.fs,
+			Ino:           snowflakeIno(handle),
+			DataStart:     handle,
+			DataChannelID: n.fs.Guild,
+		}
+		fill(desc)
+		n.desc.initChild(desc, mode, callerOwner(ctx))
+
+		childNode, err = n.newChild(ctx, desc)
+		if err != nil {
+			log.Println("Failed writing inode", err)
+			return nil, fuse.EIO
+		}
+		n.desc.touch(time.Now())
+		return append(entries, newDirEntry(name, desc)), fuse.OK
+	})
+	return childNode, code
+}
+
+func (n *Node) Readlink(ctx context.Context) ([]byte, syscall.Errno) {
+	n.lock.RLock()
+	defer n.lock.RUnlock()
+
+	if !n.desc.IsLink {
+		return nil, syscall.EINVAL
+	}
+	return []byte(n.desc.Target), fusefs.OK
+}
+
+func (n *Node) Rmdir(ctx context.Context, name string) syscall.Errno {
+	log.Println("RMDIR", n.childPath(name))
+	return errno(n.remove(name, true))
+}
+
+func (n *Node) Unlink(ctx context.Context, name string) syscall.Errno {
+	log.Println("UNLINK", n.childPath(name))
+	return errno(n.remove(name, false))
+}
+
+// Removes a name from the directory, dir says if it has to be a directory (rmdir) or can't be one (unlink)
+func (n *Node) remove(name string, dir bool) fuse.Status {
+	var removed *DirEntry
+	code := n.updateDir(func(entries []*DirEntry) ([]*DirEntry, fuse.Status) {
+		entry := findEntry(entries, name)
+		if entry == nil {
+			return nil, fuse.ENOENT
+		}
+
+		isDir := entry.Type == syscall.S_IFDIR
+		if dir && !isDir {
+			return nil, fuse.ENOTDIR
+		}
+		if !dir && isDir {
+			return nil, fuse.Status(syscall.EISDIR)
+		}
+		if dir {
+			empty, err := n.fs.dirEmpty(entry)
+			if err != nil {
+				log.Println("Failed checking if the directory is empty", err)
+				return nil, fuse.EIO
+			}
+			if !empty {
+				return nil, fuse.Status(syscall.ENOTEMPTY)
+			}
+		}
+
+		removed = entry
+		n.desc.touch(time.Now())
+		return removeEntry(entries, name, entry.Ino), fuse.OK
+	})
+	if code != fuse.OK {
+		return code
+	}
+
+	n.fs.dropLink(removed, n.childQuotaDirs())
+	return fuse.OK
+}
+
+// The fs package adds the name to the tree once this returns
+func (n *Node) Link(ctx context.Context, existing fusefs.InodeEmbedder, name string, out *fuse.EntryOut) (*fusefs.Inode, syscall.Errno) {
+	target, ok := existing.(*Node)
+	if !ok {
+		return nil, syscall.EXDEV
+	}
+
+	// The link would be in a different quota than the file is charged to
+	if !sameDirs(target.quotaDirs(), n.childQuotaDirs()) {
+		return nil, syscall.EXDEV
+	}
+
+	target.lock.Lock()
+	log.Println("LINK", target.getPath(), n.childPath(name))
+	if target.desc.IsDir {
+		target.lock.Unlock()
+		return nil, syscall.EPERM
+	}
+	// The link count goes up first, a crash in between leaves a count that's too high rather than too low
+	target.desc.link()
+	target.lock.Unlock()
+	code := target.syncInode()
+	if code != fuse.OK {
+		return nil, errno(code)
+	}
+
+	code = n.updateDir(func(entries []*DirEntry) ([]*DirEntry, fuse.Status) {
+		for _, entry := range entries {
+			if entry.Name == name {
+				return nil, fuse.Status(syscall.EEXIST)
+			}
+		}
+
+		target.lock.RLock()
+		entry := newDirEntry(name, target.desc)
+		target.lock.RUnlock()
+
+		n.desc.touch(time.Now())
+		return append(entries, entry), fuse.OK
+	})
+	if code != fuse.OK {
+		target.lock.Lock()
+		target.desc.unlink()
+		target.lock.Unlock()
+		target.syncInode()
+		return nil, errno(code)
+	}
+	return target.entryOut(out), fusefs.OK
+}
+
+func (n *Node) Utimens(h *FileHandle, atime *time.Time, mtime *time.Time) fuse.Status {
+	// Pending writes would set mtime again when they're merged
+	if h != nil {
+		h.lock.Lock()
+		defer h.lock.Unlock()
+	}
+
+	n.lock.Lock()
+	log.Println("UTIMENS", n.getPath(), atime, mtime)
+	if h != nil {
+		code := h.mergeLocked()
+		if code != fuse.OK {
+			n.lock.Unlock()
+			return code
+		}
+	}
+	n.desc.SetTimes(atime, mtime)
+	dirty := n.desc.Dirty
+	n.lock.Unlock()
+
+	if dirty {
+		// The handle writes the inode out along with the data
+		return fuse.OK
+	}
+	return n.syncInode()
+}
+
+func (n *Node) Chmod(perms uint32) fuse.Status {
+	n.lock.Lock()
+	log.Println("CHMOD", n.getPath(), perms)
+	n.desc.SetMode(perms)
+	n.lock.Unlock()
+	return n.syncInode()
+}
+
+func (n *Node) Chown(uid uint32, gid uint32) fuse.Status {
+	n.lock.Lock()
+	log.Println("CHOWN", n.getPath(), uid, gid)
+	n.desc.SetOwner(uid, gid)
+	n.lock.Unlock()
+	return n.syncInode()
+}
+
+// Updates the access time after a read, if the atime mode asks for it
+func (n *Node) accessed() {
+	if *flagAtime != "relatime" {
+		return
+	}
+
+	n.lock.Lock()
+	changed := n.desc.accessed()
+	n.lock.Unlock()
+	if changed {
+		n.syncInode()
+	}
+}
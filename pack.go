@@ -0,0 +1,366 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"log"
+	"strings"
+)
+
+// Packs. The last part of a file that's too small for a message of its own goes into a pack,
+// a message shared with other files, and the chunk refers to a range of the pack. Packs are
+// only appended to, so a range never changes while a file refers to it
+//
+// A pack holds "p", the data of its members, and after a newline its generation and the members
+// as ino:off:len. Packed chunks have no edited timestamp, it changes with every append. Packs are
+// cached by id alone, every version of a pack has the same data for the ranges it had before. A
+// message can hold another pack once it's freed and reused though, so every pack gets a random
+// generation that its chunks keep, and a cached pack of another generation is fetched again
+// Members that are gone are dropped from the list, once less than half of a pack is still in
+// use it's repacked in the background: what's left is moved to the open pack and the pack is
+// deleted. The list can have members that are gone after a crash, repacking checks the inodes
+
+const (
+	packPrefix = "p"
+	PACK_MAX   = BYTES_PER_MSG / 2 // Parts smaller than this go in a pack
+)
+
+var ErrPackBusy = errors.New("Member of pack has unflushed data")
+
+type packMember struct {
+	Ino uint64
+	Off int
+	Len int
+}
+
+type pack struct {
+	ID      string
+	gen     string
+	data    []byte
+	members []*packMember
+}
+
+func parsePack(id, content string) *pack {
+	p := &pack{ID: id}
+	content = strings.TrimPrefix(content, packPrefix)
+	i := strings.LastIndex(content, "\n")
+	if i < 0 {
+		p.data = []byte(content)
+		return p
+	}
+
+	p.data = []byte(content[:i])
+	for _, field := range strings.Split(content[i+1:], ",") {
+		if strings.HasPrefix(field, "g") {
+			p.gen = field[1:]
+			continue
+		}
+		m := &packMember{}
+		_, err := fmt.Sscanf(field, "%d:%d:%d", &m.Ino, &m.Off, &m.Len)
+		if err == nil {
+			p.members = append(p.members, m)
+		}
+	}
+	return p
+}
+
+func (p *pack) content() string {
+	fields := make([]string, 0, len(p.members)+1)
+	if p.gen != "" {
+		fields = append(fields, "g"+p.gen)
+	}
+	for _, m := range p.members {
+		fields = append(fields, fmt.Sprintf("%d:%d:%d", m.Ino, m.Off, m.Len))
+	}
+	return packPrefix + string(p.data) + "\n" + strings.Join(fields, ",")
+}
+
+// Packs made before generations have none, nor do their chunks
+func newPackGen() (string, error) {
+	b := make([]byte, 6)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", b), nil
+}
+
+// Bytes of the pack still in use
+func (p *pack) live() int {
+	live := 0
+	for _, m := range p.members {
+		live += m.Len
+	}
+	return live
+}
+
+// Splits off the packed chunk at the end, if there is one
+func splitTail(chunks []*Chunk) ([]*Chunk, *Chunk) {
+	if len(chunks) > 0 && chunks[len(chunks)-1].Len > 0 {
+		return chunks[:len(chunks)-1], chunks[len(chunks)-1]
+	}
+	return chunks, nil
+}
+
+// The ids of the messages that belong to the chunks alone, packs and chunks in the chunk index
+// are shared and holes have none
+func ownChunkIDs(chunks []*Chunk) []string {
+	ids := make([]string, 0, len(chunks))
+	for _, chunk := range chunks {
+		if chunk.Len == 0 && chunk.Hash == "" && chunk.Hole == 0 {
+			ids = append(ids, chunk.ID)
+		}
+	}
+	return ids
+}
+
+// Returns the contents of a chunk, for packed chunks only its range of the pack
+func (fs *DiscordFS) readChunk(channel string, chunk *Chunk) ([]byte, error) {
+	if chunk.Hole > 0 {
+		return holeData(chunk), nil
+	}
+	content, err := fs.fetchChunk(channel, chunk)
+	if err != nil || chunk.Len == 0 {
+		return content, err
+	}
+
+	data, ok := packRange(content, chunk)
+	if !ok {
+		// Cached before the range was added by another mount, or before the message was reused
+		fs.chunks.RemoveMessage(chunk.ID)
+		content, err = fs.fetchChunk(channel, chunk)
+		if err != nil {
+			return nil, err
+		}
+		data, ok = packRange(content, chunk)
+	}
+	if !ok {
+		return nil, fmt.Errorf("Packed chunk %s:%d:%d isn't in pack %s", chunk.Gen, chunk.Off, chunk.Len, chunk.ID)
+	}
+	return data, nil
+}
+
+// The data of a pack without the member list, content is without the prefix
+func packData(content []byte) []byte {
+	if i := bytes.LastIndexByte(content, '\n'); i >= 0 {
+		return content[:i]
+	}
+	return content
+}
+
+// The range of the packed chunk, false if the pack is of another generation or too short to have
+// it. content is without the prefix
+func packRange(content []byte, chunk *Chunk) ([]byte, bool) {
+	gen := ""
+	if i := bytes.LastIndexByte(content, '\n'); i >= 0 {
+		members := content[i+1:]
+		if bytes.HasPrefix(members, []byte("g")) {
+			gen = string(members[1:])
+			if j := strings.IndexByte(gen, ','); j >= 0 {
+				gen = gen[:j]
+			}
+		}
+	}
+	data := packData(content)
+	if gen != chunk.Gen || chunk.Off+chunk.Len > len(data) {
+		return nil, false
+	}
+	return data[chunk.Off : chunk.Off+chunk.Len], true
+}
+
+// True if the packed chunk is known to hold part already
+func (fs *DiscordFS) packedEqual(chunk *Chunk, part []byte) bool {
+	content, ok := fs.chunks.Get(chunk.ID, "")
+	if !ok {
+		return false
+	}
+	data, ok := packRange(content, chunk)
+	return ok && bytes.Equal(data, part)
+}
+
+// Appends part to the open pack, a new pack is started when it doesn't fit
+func (fs *DiscordFS) packPart(ino uint64, part []byte) (*Chunk, error) {
+	fs.packLock.Lock()
+	defer fs.packLock.Unlock()
+
+	member := &packMember{Ino: ino, Len: len(part)}
+	p := fs.openPack
+	if p != nil {
+		member.Off = len(p.data)
+		next := &pack{ID: p.ID, gen: p.gen, data: append(p.data[:len(p.data):len(p.data)], part...), members: append(p.members, member)}
+		if len(next.content()) <= BYTES_PER_MSG+1 {
+			msg, err := fs.editMessage(fs.Guild, p.ID, next.content())
+			if err != nil {
+				return nil, err
+			}
+			fs.openPack = next
+			fs.chunks.Put(msg.ID, "", []byte(next.content()[1:]))
+			return &Chunk{ID: msg.ID, Gen: p.gen, Off: member.Off, Len: member.Len}, nil
+		}
+	}
+
+	gen, err := newPackGen()
+	if err != nil {
+		return nil, err
+	}
+	member.Off = 0
+	p = &pack{gen: gen, data: part, members: []*packMember{member}}
+	msg, err := fs.allocMessage(fs.Guild, p.content())
+	if err != nil {
+		return nil, err
+	}
+	p.ID = msg.ID
+	fs.openPack = p
+	fs.chunks.Put(msg.ID, "", []byte(p.content()[1:]))
+	return &Chunk{ID: msg.ID, Gen: gen, Len: member.Len}, nil
+}
+
+// Drops the chunk of the inode from its pack. Packs nobody uses anymore are deleted, packs that
+// are mostly unused are queued for repacking
+func (fs *DiscordFS) unpack(chunk *Chunk, ino uint64) {
+	fs.packLock.Lock()
+	defer fs.packLock.Unlock()
+
+	open := fs.openPack != nil && fs.openPack.ID == chunk.ID
+	var p *pack
+	if open {
+		p = fs.openPack
+	} else {
+		msg, err := fs.fetchMessage(fs.Guild, chunk.ID)
+		if err != nil {
+			log.Println("Failed getting pack", chunk.ID, err)
+			return
+		}
+		p = parsePack(msg.ID, msg.Content)
+	}
+	if p.gen != chunk.Gen {
+		// The message was reused for another pack, the one the chunk was in is gone
+		return
+	}
+
+	members := make([]*packMember, 0, len(p.members))
+	for _, m := range p.members {
+		if m.Ino != ino || m.Off != chunk.Off {
+			members = append(members, m)
+		}
+	}
+	next := &pack{ID: p.ID, gen: p.gen, data: p.data, members: members}
+
+	if len(members) == 0 && !open {
+		err := fs.freeMessage(fs.Guild, p.ID)
+		if err != nil {
+			log.Println("Failed deleting pack", p.ID, err)
+		}
+		return
+	}
+
+	msg, err := fs.editMessage(fs.Guild, p.ID, next.content())
+	if err != nil {
+		log.Println("Failed updating pack", p.ID, err)
+		return
+	}
+	fs.chunks.Put(msg.ID, "", []byte(next.content()[1:]))
+	if open {
+		fs.openPack = next
+		return
+	}
+
+	if next.live()*2 < len(next.data) {
+		select {
+		case fs.repacks <- p.ID:
+		default:
+			// Plenty queued already, it's picked up again when another member goes
+		}
+	}
+}
+
+// Repacks the packs that are queued
+func (fs *DiscordFS) repacker() {
+	for id := range fs.repacks {
+		err := fs.repack(id)
+		if err != nil {
+			log.Println("Failed repacking", id, err)
+		}
+	}
+}
+
+// Moves the members of a pack to the open pack and deletes it
+func (fs *DiscordFS) repack(id string) error {
+	fs.packLock.Lock()
+	if fs.openPack != nil && fs.openPack.ID == id {
+		fs.packLock.Unlock()
+		return nil
+	}
+	msg, err := fs.fetchMessage(fs.Guild, id)
+	fs.packLock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	p := parsePack(msg.ID, msg.Content)
+	log.Println("Repacking", id, "with", len(p.members), "members,", p.live(), "of", len(p.data), "in use")
+	for _, m := range p.members {
+		if m.Off+m.Len > len(p.data) {
+			continue
+		}
+		err = fs.movePacked(p, m, p.data[m.Off:m.Off+m.Len])
+		if err != nil {
+			return err
+		}
+	}
+
+	fs.packLock.Lock()
+	defer fs.packLock.Unlock()
+	return fs.freeMessage(fs.Guild, id)
+}
+
+// Moves a member of a pack to the open pack, if the inode still uses it
+func (fs *DiscordFS) movePacked(p *pack, m *packMember, part []byte) error {
+	if node := fs.getNode(m.Ino); node != nil {
+		node.lock.Lock()
+		defer node.lock.Unlock()
+		if node.desc.Dirty || node.desc.unlinked {
+			// The inode table doesn't match what's in memory
+			return ErrPackBusy
+		}
+		moved, err := node.desc.repoint(p, m.Off, part)
+		if err != nil || !moved {
+			return err
+		}
+		if code := node.syncInodeLocked(); code != fuse.OK {
+			return errors.New("Failed writing inode: " + code.String())
+		}
+		return nil
+	}
+
+	desc, err := fs.loadInode(m.Ino)
+	if err != nil {
+		return err
+	}
+	moved, err := desc.repoint(p, m.Off, part)
+	if err != nil || !moved {
+		return err
+	}
+	return desc.WriteInode()
+}
+
+// Points the chunk at off in the pack to a copy of part in the open pack. Returns false if
+// the inode doesn't use the pack anymore
+func (f *FileDesc) repoint(p *pack, off int, part []byte) (bool, error) {
+	for i, chunk := range f.Chunks {
+		if chunk.ID != p.ID || chunk.Gen != p.gen || chunk.Off != off || chunk.Len == 0 {
+			continue
+		}
+		moved, err := f.FS.packPart(f.InodeNumber(), part)
+		if err != nil {
+			return false, err
+		}
+		f.Chunks[i] = moved
+		f.InodeDirty = true
+		return true, nil
+	}
+	return false, nil
+}
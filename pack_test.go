@@ -0,0 +1,43 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+// A pack cached before its message was freed and reused by another mount has other data in the
+// same ranges, it's told apart by the generation and fetched again
+func TestStalePackIsFetchedAgain(t *testing.T) {
+	fs, root, _ := newTestFS(t)
+	cache, err := NewChunkCache(t.TempDir(), 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs.chunks = cache
+
+	file := writeFile(t, root, "small", bytes.Repeat([]byte("x"), 600))
+	tail := file.desc.Chunks[len(file.desc.Chunks)-1]
+	if tail.Len == 0 || tail.Gen == "" {
+		t.Fatalf("last chunk %+v isn't packed with a generation", tail)
+	}
+	want, err := fs.readChunk(testGuild, tail)
+	if err != nil {
+		t.Fatal("reading packed chunk", err)
+	}
+
+	members := fmt.Sprintf("%d:%d:%d", file.ino, tail.Off, tail.Len)
+	for _, stale := range []string{"gstale," + members, members} {
+		cache.Put(tail.ID, "", append(bytes.Repeat([]byte("B"), tail.Off+tail.Len), "\n"+stale...))
+		got, err := fs.readChunk(testGuild, tail)
+		if err != nil {
+			t.Fatal("reading packed chunk", err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("read the cached pack with members %s", stale)
+		}
+		if !fs.packedEqual(tail, want) {
+			t.Error("chunk doesn't match the pack fetched again")
+		}
+	}
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"log"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Quotas. A directory can limit the bytes and files below it, the limits and the usage are
+// stored in its inode. Like the superblock the usage is counted in memory and written every
+// superblockInterval
+//
+// Usage is charged to the directories with quotas above a node, found through the names the
+// kernel knows. So the usage stays right, directories and files with more than one link
+// can't move between quotas (EXDEV, like project quotas on xfs, mv copies them instead)
+//
+// Limits are set with xattrs on the directory, a quota on the root limits the whole filesystem.
+// Only root and the owner of the directory can change them, unlike other user xattrs
+
+const (
+	quotaXattrBytes = "user.discord-fs.quota.bytes"
+	quotaXattrFiles = "user.discord-fs.quota.files"
+)
+
+type Quota struct {
+	MaxBytes int64 `json:"max_bytes,omitempty"` // Zero for no limit
+	MaxFiles int64 `json:"max_files,omitempty"`
+	Bytes    int64 `json:"bytes"`
+	Files    int64 `json:"files"` // Including the directory itself
+}
+
+func isQuotaXattr(name string) bool {
+	return name == quotaXattrBytes || name == quotaXattrFiles
+}
+
+func (fs *DiscordFS) hasQuota(ino uint64) bool {
+	fs.usageLock.Lock()
+	defer fs.usageLock.Unlock()
+	_, ok := fs.quotas[ino]
+	return ok
+}
+
+// A copy of the quota of the directory with the current usage, nil if it has none
+func (fs *DiscordFS) quota(ino uint64) *Quota {
+	fs.usageLock.Lock()
+	defer fs.usageLock.Unlock()
+	q, ok := fs.quotas[ino]
+	if !ok {
+		return nil
+	}
+	quota := *q
+	return &quota
+}
+
+// Starts tracking the quota of a directory that was loaded, unless it already is
+func (fs *DiscordFS) registerQuota(ino uint64, q *Quota) {
+	fs.usageLock.Lock()
+	defer fs.usageLock.Unlock()
+	if _, ok := fs.quotas[ino]; !ok {
+		quota := *q
+		fs.quotas[ino] = &quota
+	}
+}
+
+// Replaces the usage of the quotas with what was counted, after a crash the stored usage may
+// be behind. They're written on the next superblockInterval
+func (fs *DiscordFS) setQuotas(counted map[uint64]*Quota) {
+	fs.usageLock.Lock()
+	defer fs.usageLock.Unlock()
+	for ino, q := range counted {
+		fs.quotas[ino] = q
+		fs.quotaDirty[ino] = true
+	}
+}
+
+func (fs *DiscordFS) dropQuota(ino uint64) {
+	fs.usageLock.Lock()
+	defer fs.usageLock.Unlock()
+	delete(fs.quotas, ino)
+	delete(fs.quotaDirty, ino)
+}
+
+func (fs *DiscordFS) charge(dirs []uint64, files, bytes int64) {
+	if len(dirs) < 1 || files == 0 && bytes == 0 {
+		return
+	}
+
+	fs.usageLock.Lock()
+	defer fs.usageLock.Unlock()
+	for _, ino := range dirs {
+		if q, ok := fs.quotas[ino]; ok {
+			q.Files += files
+			q.Bytes += bytes
+			fs.quotaDirty[ino] = true
+		}
+	}
+}
+
+// Returns EDQUOT if adding files and bytes goes over a quota, ENOSPC for the quota on the root
+func (fs *DiscordFS) checkQuota(dirs []uint64, files, bytes int64) fuse.Status {
+	fs.usageLock.Lock()
+	defer fs.usageLock.Unlock()
+	for _, ino := range dirs {
+		q, ok := fs.quotas[ino]
+		if !ok {
+			continue
+		}
+		if q.MaxFiles > 0 && files > 0 && q.Files+files > q.MaxFiles || q.MaxBytes > 0 && bytes > 0 && q.Bytes+bytes > q.MaxBytes {
+			if ino == fs.rootIno {
+				return fuse.Status(syscall.ENOSPC)
+			}
+			return fuse.Status(syscall.EDQUOT)
+		}
+	}
+	return fuse.OK
+}
+
+// Writes the quota of a directory, WriteInode picks up the usage
+func (fs *DiscordFS) writeQuota(ino uint64) {
+	if node := fs.getNode(ino); node != nil {
+		node.lock.Lock()
+		node.desc.InodeDirty = true
+		node.syncInodeLocked()
+		node.lock.Unlock()
+		return
+	}
+
+	desc, err := fs.loadInode(ino)
+	if err == nil {
+		err = desc.WriteInode()
+	}
+	if err != nil {
+		log.Println("Failed writing quota of", ino, err)
+	}
+}
+
+// The directories with quotas above the node
+func (n *Node) quotaDirs() []uint64 {
+	dirs := make([]uint64, 0)
+	for inode := n.EmbeddedInode(); inode != nil; {
+		_, parent := inode.Parent()
+		if parent == nil {
+			break
+		}
+		if dir, ok := parent.Operations().(*Node); ok && n.fs.hasQuota(dir.ino) {
+			dirs = append(dirs, dir.ino)
+		}
+		inode = parent
+	}
+	return dirs
+}
+
+// The directories with quotas above a child of the node, including the node itself
+func (n *Node) childQuotaDirs() []uint64 {
+	dirs := n.quotaDirs()
+	if n.fs.hasQuota(n.ino) {
+		dirs = append(dirs, n.ino)
+	}
+	return dirs
+}
+
+func sameDirs(a, b []uint64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Checks the quotas above the node before the file grows to size
+func (n *Node) checkSize(size int64) fuse.Status {
+	n.lock.RLock()
+	stored := int64(n.desc.storedSize)
+	n.lock.RUnlock()
+	return n.fs.checkQuota(n.quotaDirs(), 0, size-stored)
+}
+
+// The stored size and link count of the inode of entry
+func (fs *DiscordFS) inodeUsage(entry *DirEntry) (int64, int, error) {
+	if node := fs.getNode(entry.Ino); node != nil {
+		node.lock.RLock()
+		defer node.lock.RUnlock()
+		return int64(node.desc.storedSize), node.desc.links(), nil
+	}
+
+	desc := entry.legacy
+	if desc == nil {
+		var err error
+		desc, err = fs.loadInode(entry.Ino)
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	return int64(desc.storedSize), desc.links(), nil
+}
+
+func (n *Node) getQuotaXattr(name string) ([]byte, fuse.Status) {
+	q := n.fs.quota(n.ino)
+	if q == nil {
+		return nil, fuse.ENODATA
+	}
+	limit := q.MaxBytes
+	if name == quotaXattrFiles {
+		limit = q.MaxFiles
+	}
+	if limit == 0 {
+		return nil, fuse.ENODATA
+	}
+	return []byte(strconv.FormatInt(limit, 10)), fuse.OK
+}
+
+// Whether the caller may change the limits of the directory. Goes by the owner the kernel
+// checks against, which mount options can override
+func (n *Node) mayChangeQuota(ctx context.Context) bool {
+	caller := callerOwner(ctx)
+	if *flagIgnorePerms || caller.Uid == 0 {
+		return true
+	}
+	var attr fuse.Attr
+	n.lock.RLock()
+	n.desc.GetAttr(&attr)
+	n.lock.RUnlock()
+	return caller.Uid == attr.Uid
+}
+
+// Sets a limit of the quota on the directory, zero removes it. The usage is counted when the
+// directory gets its first limit
+func (n *Node) setQuotaLimit(name string, limit int64) fuse.Status {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	log.Println("SETQUOTA", n.getPath(), name, limit)
+	if !n.desc.IsDir {
+		return fuse.ENOTDIR
+	}
+
+	var counted *Quota
+	if !n.fs.hasQuota(n.ino) {
+		if limit == 0 {
+			return fuse.ENODATA
+		}
+		usage, _, _, err := n.fs.countUsage(n.desc)
+		if err != nil {
+			log.Println("Failed counting usage", err)
+			return fuse.EIO
+		}
+		counted = &Quota{Bytes: usage.Bytes, Files: usage.Files}
+	}
+
+	n.fs.usageLock.Lock()
+	q, ok := n.fs.quotas[n.ino]
+	if !ok && counted == nil {
+		// Freed in the meantime
+		n.fs.usageLock.Unlock()
+		return fuse.ENOENT
+	}
+	if !ok {
+		q = counted
+		n.fs.quotas[n.ino] = q
+	}
+	if name == quotaXattrFiles {
+		q.MaxFiles = limit
+	} else {
+		q.MaxBytes = limit
+	}
+	if q.MaxBytes == 0 && q.MaxFiles == 0 {
+		delete(n.fs.quotas, n.ino)
+		delete(n.fs.quotaDirty, n.ino)
+	}
+	n.fs.usageLock.Unlock()
+
+	// Gone if both limits are, otherwise WriteInode fills it in
+	n.desc.Quota = nil
+	n.desc.changed()
+	return n.syncInodeLocked()
+}
+
+func (n *Node) setQuotaXattr(name string, data []byte) fuse.Status {
+	limit, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil || limit < 0 {
+		return fuse.EINVAL
+	}
+	return n.setQuotaLimit(name, limit)
+}
+
+// Shows the usage of the filesystem and the quota of the directory at path, for the usage command
+func (fs *DiscordFS) printUsage(path string) error {
+	root, err := fs.GetRoot()
+	if err != nil {
+		return err
+	}
+	if root.Super != nil {
+		fmt.Printf("Filesystem %s: %d files, %d bytes in %d messages\n", root.Super.UUID, root.Super.Files, root.Super.Bytes, root.Super.Messages)
+	}
+
+	path = strings.Trim(path, "/")
+	desc := root
+	for _, name := range strings.Split(path, "/") {
+		if name == "" {
+			continue
+		}
+		entry, err := desc.GetChild(name)
+		if err != nil {
+			return err
+		}
+		desc, err = fs.loadInode(entry.Ino)
+		if err != nil {
+			return err
+		}
+	}
+
+	q := desc.Quota
+	if q == nil {
+		fmt.Printf("/%s: no quota\n", path)
+		return nil
+	}
+	fmt.Printf("/%s: %s bytes, %s files\n", path, usageOf(q.Bytes, q.MaxBytes), usageOf(q.Files, q.MaxFiles))
+	return nil
+}
+
+func usageOf(used, limit int64) string {
+	if limit == 0 {
+		return fmt.Sprintf("%d (no limit)", used)
+	}
+	return fmt.Sprintf("%d of %d (%d%%)", used, limit, used*100/limit)
+}
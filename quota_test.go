@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"syscall"
+	"testing"
+)
+
+// Anyone who can write a directory can set its user xattrs, the limits only root and the owner
+func TestQuotaLimitsNeedOwner(t *testing.T) {
+	_, root, _ := newTestFS(t)
+	as := func(uid uint32) context.Context {
+		return fuse.NewContext(context.Background(), &fuse.Caller{Owner: fuse.Owner{Uid: uid, Gid: uid}})
+	}
+
+	inode, code := root.Mkdir(as(1000), "shared", 0777, &fuse.EntryOut{})
+	if code != 0 {
+		t.Fatal("mkdir", code)
+	}
+	dir := inode.Operations().(*Node)
+
+	if code := dir.Setxattr(as(1001), quotaXattrBytes, []byte("100"), 0); code != syscall.EPERM {
+		t.Error("other user setting the limit got", code)
+	}
+	if code := dir.Setxattr(as(1001), "user.comment", []byte("mine"), 0); code != 0 {
+		t.Error("other user setting an xattr got", code)
+	}
+	for _, uid := range []uint32{1000, 0} {
+		if code := dir.Setxattr(as(uid), quotaXattrBytes, []byte("100"), 0); code != 0 {
+			t.Error("uid", uid, "setting the limit got", code)
+		}
+	}
+	if code := dir.Removexattr(as(1001), quotaXattrBytes); code != syscall.EPERM {
+		t.Error("other user removing the limit got", code)
+	}
+	if n, code := dir.Getxattr(as(1001), quotaXattrBytes, make([]byte, 10)); code != 0 || n != 3 {
+		t.Error("limit is gone", n, code)
+	}
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	fusefs "github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"log"
+	"syscall"
+	"time"
+)
+
+// Renames. Within a directory a rename is one write of the directory, between directories it
+// takes two. So a crash in between can't lose the entry, the rename is written to the journal
+// first and finished on the next mount if it's still there
+//
+// The journal is a single message, its id is stored in the root inode. It holds one rename at
+// a time, renames between directories wait for the one before to clear it
+
+// rename2 flags
+const (
+	RENAME_NOREPLACE = 1
+	RENAME_EXCHANGE  = 2
+)
+
+const journalPrefix = "j"
+
+// What a rename is about to do, applying it again does nothing
+type renameIntent struct {
+	SrcDir  uint64    `json:"src_dir"`
+	SrcName string    `json:"src_name"`
+	DstDir  uint64    `json:"dst_dir"`
+	DstName string    `json:"dst_name"`
+	Moved   *DirEntry `json:"moved"`             // Moves from src to dst
+	Swapped *DirEntry `json:"swapped,omitempty"` // With RENAME_EXCHANGE, moves from dst to src
+}
+
+func findEntry(entries []*DirEntry, name string) *DirEntry {
+	for _, entry := range entries {
+		if entry.Name == name {
+			return entry
+		}
+	}
+	return nil
+}
+
+// Points name at the inode of entry, replacing what was there
+func setEntry(entries []*DirEntry, name string, entry *DirEntry) []*DirEntry {
+	newEntry := &DirEntry{Name: name, Ino: entry.Ino, Type: entry.Type}
+	for k, existing := range entries {
+		if existing.Name == name {
+			entries[k] = newEntry
+			return entries
+		}
+	}
+	return append(entries, newEntry)
+}
+
+// Removes name if it still points at the inode
+func removeEntry(entries []*DirEntry, name string, ino uint64) []*DirEntry {
+	for k, existing := range entries {
+		if existing.Name == name && existing.Ino == ino {
+			return append(entries[:k], entries[k+1:]...)
+		}
+	}
+	return entries
+}
+
+func (r *renameIntent) applyDst(entries []*DirEntry) []*DirEntry {
+	return setEntry(entries, r.DstName, r.Moved)
+}
+
+func (r *renameIntent) applySrc(entries []*DirEntry) []*DirEntry {
+	if r.Swapped != nil {
+		return setEntry(entries, r.SrcName, r.Swapped)
+	}
+	return removeEntry(entries, r.SrcName, r.Moved.Ino)
+}
+
+func (n *Node) Rename(ctx context.Context, oldName string, newParent fusefs.InodeEmbedder, newName string, flags uint32) syscall.Errno {
+	dst, ok := newParent.(*Node)
+	if !ok {
+		return syscall.EXDEV
+	}
+	return errno(n.rename(oldName, dst, newName, flags))
+}
+
+// Like rename2(2), RENAME_WHITEOUT is only for overlay filesystems
+func (n *Node) rename(oldName string, dst *Node, newName string, flags uint32) fuse.Status {
+	if flags&^(RENAME_NOREPLACE|RENAME_EXCHANGE) != 0 {
+		return fuse.EINVAL
+	}
+	if flags&RENAME_NOREPLACE != 0 && flags&RENAME_EXCHANGE != 0 {
+		return fuse.EINVAL
+	}
+
+	replaced, code := n.renameLocked(oldName, dst, newName, flags)
+	if code != fuse.OK {
+		return code
+	}
+
+	// After the journal is cleared, a crash before this leaks the old file rather than losing a name
+	if replaced != nil {
+		n.fs.dropLink(replaced, dst.childQuotaDirs())
+	}
+	return fuse.OK
+}
+
+// Locks both directories and writes the rename. Returns the entry that was replaced, if any
+func (n *Node) renameLocked(oldName string, dst *Node, newName string, flags uint32) (replaced *DirEntry, code fuse.Status) {
+	cross := dst != n
+
+	// The kernel holds both directories for the whole rename, the order only matters against
+	// our own refreshes, which lock one directory at a time
+	first, second := n, dst
+	if cross && dst.ino < n.ino {
+		first, second = dst, n
+	}
+	first.lock.Lock()
+	defer first.lock.Unlock()
+	if cross {
+		second.lock.Lock()
+		defer second.lock.Unlock()
+	}
+
+	log.Println("RENAME", n.childPath(oldName), dst.childPath(newName), flags)
+	srcEntries, err := n.desc.GetDirEntries()
+	if err != nil {
+		log.Println("Failed getting entries", err)
+		return nil, fuse.EIO
+	}
+	dstEntries := srcEntries
+	if cross {
+		dstEntries, err = dst.desc.GetDirEntries()
+		if err != nil {
+			log.Println("Failed getting entries", err)
+			return nil, fuse.EIO
+		}
+	}
+
+	moved := findEntry(srcEntries, oldName)
+	if moved == nil {
+		return nil, fuse.ENOENT
+	}
+	replaced = findEntry(dstEntries, newName)
+	exchange := flags&RENAME_EXCHANGE != 0
+	switch {
+	case exchange && replaced == nil:
+		return nil, fuse.ENOENT
+	case flags&RENAME_NOREPLACE != 0 && replaced != nil:
+		return nil, fuse.Status(syscall.EEXIST)
+	case !exchange && replaced != nil && replaced.Ino == moved.Ino:
+		// Both names are links to the same file, rename does nothing then
+		return nil, fuse.OK
+	}
+
+	if !exchange && replaced != nil && replaced.Type == syscall.S_IFDIR {
+		empty, err := n.fs.dirEmpty(replaced)
+		if err != nil {
+			log.Println("Failed checking if the target is empty", err)
+			return nil, fuse.EIO
+		}
+		if !empty {
+			return nil, fuse.Status(syscall.ENOTEMPTY)
+		}
+	}
+
+	// Files moving to another quota take their usage along, anything else can't be moved
+	srcQuotas, dstQuotas := n.childQuotaDirs(), dst.childQuotaDirs()
+	var movedSize int64
+	crossQuota := cross && !sameDirs(srcQuotas, dstQuotas)
+	if crossQuota {
+		if exchange || moved.Type == syscall.S_IFDIR {
+			return nil, fuse.EXDEV
+		}
+		size, links, err := n.fs.inodeUsage(moved)
+		if err != nil {
+			log.Println("Failed loading inode", moved.Ino, err)
+			return nil, fuse.EIO
+		}
+		if links > 1 {
+			return nil, fuse.EXDEV
+		}
+		if code := n.fs.checkQuota(dstQuotas, 1, size); code != fuse.OK {
+			return nil, code
+		}
+		movedSize = size
+	}
+
+	intent := &renameIntent{
+		SrcDir:  n.ino,
+		SrcName: oldName,
+		DstDir:  dst.ino,
+		DstName: newName,
+		Moved:   moved,
+	}
+	if exchange {
+		intent.Swapped = replaced
+	}
+
+	now := time.Now()
+	n.desc.touch(now)
+	if !cross {
+		code = n.writeEntries(intent.applySrc(intent.applyDst(srcEntries)))
+	} else {
+		dst.desc.touch(now)
+		code = n.fs.renameJournaled(intent, n, dst, srcEntries, dstEntries)
+	}
+	if code != fuse.OK {
+		return nil, code
+	}
+
+	if crossQuota {
+		n.fs.charge(srcQuotas, -1, -movedSize)
+		n.fs.charge(dstQuotas, 1, movedSize)
+	}
+
+	// go-fuse moves the nodes the kernel knows about along, nodes below them have nothing to update
+	if exchange {
+		return nil, fuse.OK
+	}
+	return replaced, fuse.OK
+}
+
+// Writes both directories of a rename between directories, with the journal around it
+// Caller must hold the locks of both directories
+func (fs *DiscordFS) renameJournaled(intent *renameIntent, src, dst *Node, srcEntries, dstEntries []*DirEntry) fuse.Status {
+	// Always taken after the directories, nothing waits on them while holding it
+	fs.journalLock.Lock()
+	defer fs.journalLock.Unlock()
+
+	err := fs.writeJournal(intent)
+	if err != nil {
+		log.Println("Failed writing journal", err)
+		return fuse.EIO
+	}
+
+	code := dst.writeEntries(intent.applyDst(dstEntries))
+	if code != fuse.OK {
+		// Nothing changed, the journal can go
+		fs.writeJournal(nil)
+		return code
+	}
+
+	code = src.writeEntries(intent.applySrc(srcEntries))
+	if code != fuse.OK {
+		log.Println("Failed writing source directory of rename, it's finished on the next mount")
+		return code
+	}
+
+	err = fs.writeJournal(nil)
+	if err != nil {
+		log.Println("Failed clearing journal, the rename is applied again on the next mount", err)
+	}
+	return fuse.OK
+}
+
+// Sets the pending rename, nil clears it
+func (fs *DiscordFS) writeJournal(intent *renameIntent) error {
+	content := journalPrefix
+	if intent != nil {
+		encoded, err := json.Marshal(intent)
+		if err != nil {
+			return err
+		}
+		content += string(encoded)
+	}
+	_, err := fs.editMessage(fs.Guild, fs.journal, content)
+	return err
+}
+
+// Sends the journal message, for filesystems that don't have one yet
+func (fs *DiscordFS) createJournal(root *FileDesc) error {
+	msg, err := fs.sendMessage(fs.Guild, journalPrefix)
+	if err != nil {
+		return err
+	}
+	root.Journal = msg.ID
+	return root.WriteInode()
+}
+
+// Finishes a rename that was interrupted, before mounting. Returns true if there was one
+func (fs *DiscordFS) replayJournal() (bool, error) {
+	msg, err := fs.fetchMessage(fs.Guild, fs.journal)
+	if err != nil {
+		return false, err
+	}
+	if len(msg.Content) <= len(journalPrefix) {
+		return false, nil
+	}
+
+	var intent *renameIntent
+	err = json.Unmarshal([]byte(msg.Content[len(journalPrefix):]), &intent)
+	if err != nil {
+		return false, err
+	}
+
+	log.Println("Finishing interrupted rename of", intent.SrcName, "to", intent.DstName)
+	err = fs.editDirInode(intent.DstDir, intent.applyDst)
+	if err != nil {
+		return false, err
+	}
+	err = fs.editDirInode(intent.SrcDir, intent.applySrc)
+	if err != nil {
+		return false, err
+	}
+	return true, fs.writeJournal(nil)
+}
+
+// Changes the entries of a directory that has no node yet
+func (fs *DiscordFS) editDirInode(ino uint64, fn func(entries []*DirEntry) []*DirEntry) error {
+	desc, err := fs.loadInode(ino)
+	if err != nil {
+		return err
+	}
+	entries, err := desc.GetDirEntries()
+	if err != nil {
+		return err
+	}
+
+	serialized, err := json.Marshal(fn(entries))
+	if err != nil {
+		return err
+	}
+	desc.Cache = serialized
+	if code := desc.Flush(); code != fuse.OK {
+		return errors.New("Failed writing directory: " + code.String())
+	}
+	if desc.InodeDirty {
+		return desc.WriteInode()
+	}
+	return nil
+}
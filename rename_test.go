@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/jonas747/discordgo"
+	"syscall"
+	"testing"
+)
+
+func mkdir(t *testing.T, dir *Node, name string) *Node {
+	inode, code := dir.Mkdir(context.Background(), name, 0755, &fuse.EntryOut{})
+	if code != 0 {
+		t.Fatal("mkdir", name, code)
+	}
+	return inode.Operations().(*Node)
+}
+
+// The inode number the name in the stored directory points at, zero if it's not there
+func storedEntry(t *testing.T, fs *DiscordFS, dir uint64, name string) uint64 {
+	desc, err := fs.loadInode(dir)
+	if err != nil {
+		t.Fatal("loading directory", err)
+	}
+	entries, err := desc.GetDirEntries()
+	if err != nil {
+		t.Fatal("reading directory", err)
+	}
+	if entry := findEntry(entries, name); entry != nil {
+		return entry.Ino
+	}
+	return 0
+}
+
+// A move between directories left in the journal, before or after the destination was written,
+// is finished by the next mount
+func TestRenameJournalIsReplayed(t *testing.T) {
+	for _, dstWritten := range []bool{false, true} {
+		fs, root, api := newTestFS(t)
+		src, dst := mkdir(t, root, "src"), mkdir(t, root, "dst")
+		file := writeFile(t, src, "file", []byte("moved"))
+
+		entries, err := src.desc.GetDirEntries()
+		if err != nil {
+			t.Fatal(err)
+		}
+		intent := &renameIntent{SrcDir: src.ino, SrcName: "file", DstDir: dst.ino, DstName: "moved", Moved: findEntry(entries, "file")}
+		if err := fs.writeJournal(intent); err != nil {
+			t.Fatal("writing journal", err)
+		}
+		if dstWritten {
+			if err := fs.editDirInode(dst.ino, intent.applyDst); err != nil {
+				t.Fatal("writing destination", err)
+			}
+		}
+
+		next := NewFS(&discordgo.Session{}, testGuild, nil)
+		next.api = api
+		next.journal = fs.journal
+		replayed, err := next.replayJournal()
+		if err != nil || !replayed {
+			t.Fatal("replaying journal", replayed, err)
+		}
+		if ino := storedEntry(t, next, dst.ino, "moved"); ino != file.ino {
+			t.Error("destination has", ino, "want", file.ino, "destination written:", dstWritten)
+		}
+		if ino := storedEntry(t, next, src.ino, "file"); ino != 0 {
+			t.Error("source still has the file, destination written:", dstWritten)
+		}
+		if replayed, err = next.replayJournal(); replayed || err != nil {
+			t.Error("journal wasn't cleared", err)
+		}
+	}
+}
+
+func TestRenameFlags(t *testing.T) {
+	fs, root, _ := newTestFS(t)
+	ctx := context.Background()
+	a, b := mkdir(t, root, "a"), mkdir(t, root, "b")
+	x := writeFile(t, a, "x", []byte("x"))
+	y := writeFile(t, b, "y", []byte("y"))
+
+	if code := a.Rename(ctx, "x", b, "y", RENAME_NOREPLACE); code != syscall.EEXIST {
+		t.Error("RENAME_NOREPLACE over an existing file got", code)
+	}
+	if code := a.Rename(ctx, "x", b, "z", RENAME_EXCHANGE); code != syscall.ENOENT {
+		t.Error("RENAME_EXCHANGE with a missing target got", code)
+	}
+	if code := a.Rename(ctx, "x", b, "y", RENAME_EXCHANGE|RENAME_NOREPLACE); code != syscall.EINVAL {
+		t.Error("both flags got", code)
+	}
+	if storedEntry(t, fs, a.ino, "x") != x.ino || storedEntry(t, fs, b.ino, "y") != y.ino {
+		t.Fatal("a failed rename changed the directories")
+	}
+
+	if code := a.Rename(ctx, "x", b, "y", RENAME_EXCHANGE); code != 0 {
+		t.Fatal("RENAME_EXCHANGE", code)
+	}
+	if storedEntry(t, fs, a.ino, "x") != y.ino || storedEntry(t, fs, b.ino, "y") != x.ino {
+		t.Error("names weren't swapped")
+	}
+
+	if code := b.Rename(ctx, "y", a, "z", RENAME_NOREPLACE); code != 0 {
+		t.Fatal("RENAME_NOREPLACE to a new name", code)
+	}
+	if storedEntry(t, fs, a.ino, "z") != x.ino || storedEntry(t, fs, b.ino, "y") != 0 {
+		t.Error("file wasn't moved")
+	}
+}
@@ -0,0 +1,450 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"log"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Sparse files. A chunk that's nothing but zeros isn't sent, it's stored as a hole: a range of
+// the file without a message that reads as zeros. Punching a hole zeroes the range, the
+// messages of the chunks that end up all zero are freed on flush like any other chunk
+//
+// Holes are cut like the rest of the chunks, so only zeros filling a whole chunk become one.
+// Growing a file adds its holes directly, the zeros are never in memory. Files with holes aren't
+// loaded whole to be read, reads fetch the chunks they're in and holes read as zeros. Punching a
+// hole in a file that isn't loaded works chunk by chunk as well
+
+const (
+	fallocKeepSize  = 0x01 // FALLOC_FL_KEEP_SIZE
+	fallocPunchHole = 0x02 // FALLOC_FL_PUNCH_HOLE
+
+	seekData = 3 // SEEK_DATA
+	seekHole = 4 // SEEK_HOLE
+
+	// Multiples of this many bytes end on a chunk boundary, they encode to whole chunks
+	holeAlign = BYTES_PER_MSG * 3
+
+	base64Chars = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789+/"
+)
+
+// The chunks of a file. A grown file has long runs of the same hole, they're stored as one
+// so the inode doesn't grow with them
+type chunkList []*Chunk
+
+func (l chunkList) MarshalJSON() ([]byte, error) {
+	stored := make([]*Chunk, 0, len(l))
+	for _, chunk := range l {
+		if chunk.Hole == 0 {
+			stored = append(stored, chunk)
+			continue
+		}
+		if last := len(stored) - 1; last >= 0 && stored[last].Hole == chunk.Hole {
+			stored[last].Repeat++
+			continue
+		}
+		// Copied, the count is only for storing
+		stored = append(stored, &Chunk{Hole: chunk.Hole})
+	}
+	return json.Marshal(stored)
+}
+
+func (l *chunkList) UnmarshalJSON(data []byte) error {
+	var stored []*Chunk
+	err := json.Unmarshal(data, &stored)
+	if err != nil || stored == nil {
+		return err
+	}
+
+	chunks := make(chunkList, 0, len(stored))
+	for _, chunk := range stored {
+		repeat := chunk.Repeat
+		chunk.Repeat = 0
+		chunks = append(chunks, chunk)
+		for i := 0; i < repeat; i++ {
+			chunks = append(chunks, &Chunk{Hole: chunk.Hole})
+		}
+	}
+	*l = chunks
+	return nil
+}
+
+// Zero bytes encode to A, a part that's all A is all zeros
+func isZeroPart(part []byte) bool {
+	for _, c := range part {
+		if c != 'A' {
+			return false
+		}
+	}
+	return len(part) > 0
+}
+
+func holeData(chunk *Chunk) []byte {
+	return bytes.Repeat([]byte{'A'}, chunk.Hole)
+}
+
+// Whether the file is read from its chunks a range at a time rather than loaded whole, true for
+// files with fixed chunks and holes
+func (f *FileDesc) sparse() bool {
+	if f.Inline || f.CDC {
+		return false
+	}
+	for _, chunk := range f.Chunks {
+		if chunk.Hole > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Characters of the encoded data in the chunk, full chunks for all but packed and hole chunks.
+// The last chunk can be shorter
+func chunkLen(chunk *Chunk) int {
+	switch {
+	case chunk.Hole > 0:
+		return chunk.Hole
+	case chunk.Len > 0:
+		return chunk.Len
+	}
+	return BYTES_PER_MSG
+}
+
+// The characters in [start, end) of the encoded data. Sparse files that aren't loaded are read
+// from the chunks the range is in, with the end from the tail after an append
+func (f *FileDesc) encodedRange(start, end int) ([]byte, error) {
+	if f.Cache != nil || !f.sparse() {
+		data, err := f.GetData()
+		if err != nil {
+			return nil, err
+		}
+		if end > len(data) {
+			end = len(data)
+		}
+		if start > end {
+			start = end
+		}
+		return data[start:end], nil
+	}
+
+	chunks := f.Chunks
+	if f.tail != nil {
+		chunks = chunks[:f.tailStart]
+	}
+	encoded := make([]byte, 0, end-start)
+	pos := 0
+	for _, chunk := range chunks {
+		n := chunkLen(chunk)
+		from, to := start-pos, end-pos
+		pos += n
+		if to <= 0 || from >= n {
+			continue
+		}
+		if from < 0 {
+			from = 0
+		}
+		if to > n {
+			to = n
+		}
+		if chunk.Hole > 0 {
+			encoded = append(encoded, bytes.Repeat([]byte{'A'}, to-from)...)
+			continue
+		}
+		content, err := f.FS.readChunk(f.DataChannelID, chunk)
+		if err != nil {
+			return nil, err
+		}
+		if to > len(content) {
+			to = len(content)
+		}
+		if from < to {
+			encoded = append(encoded, content[from:to]...)
+		}
+	}
+
+	if f.tail != nil {
+		from, to := start-pos, end-pos
+		if from < 0 {
+			from = 0
+		}
+		if to > len(f.tail) {
+			to = len(f.tail)
+		}
+		if from < to {
+			encoded = append(encoded, f.tail[from:to]...)
+		}
+	}
+	return encoded, nil
+}
+
+// fallocate, without KEEP_SIZE the file grows to the end of the range. Nothing is reserved,
+// growing only adds holes
+func (f *FileDesc) Allocate(off, size uint64, mode uint32) fuse.Status {
+	switch mode {
+	case 0:
+		if off+size > uint64(f.Size) {
+			return f.Truncate(off + size)
+		}
+		return fuse.OK
+	case fallocKeepSize:
+		return fuse.OK
+	case fallocKeepSize | fallocPunchHole:
+		return f.punchHole(off, size)
+	}
+	return fuse.Status(syscall.EOPNOTSUPP)
+}
+
+// Zero extends the file to size. With fixed chunks the end is padded with zeros up to a chunk
+// boundary and flushed, whole chunks of zeros after it are added as holes and only the last
+// part is left to send. Smaller growth is appended like any other data
+func (f *FileDesc) grow(size int) fuse.Status {
+	padded := (f.Size + holeAlign - 1) / holeAlign * holeAlign
+	legacy := f.Chunks == nil && f.DataMsgCount > 0
+	if f.CDC || *flagChunking == "cdc" || legacy || size-padded < holeAlign {
+		return f.appendZeros(size - f.Size)
+	}
+
+	code := f.appendZeros(padded - f.Size)
+	if code != fuse.OK {
+		return code
+	}
+	code = f.Flush()
+	if code != fuse.OK {
+		return code
+	}
+	if padded == 0 {
+		// Was empty, what's stored for it goes and the data is in chunks from here. Every
+		// chunk but the last has to be a whole one
+		f.garbage = append(f.garbage, f.Chunks...)
+		f.Chunks = nil
+		f.Inline = false
+		f.InlineData = ""
+		f.InodeDirty = true
+	}
+
+	// The last part holds the final group of characters, with the padding
+	encoded := fileDataEncoder.EncodedLen(size - padded)
+	holes := (encoded - 4) / BYTES_PER_MSG
+	for i := 0; i < holes; i++ {
+		f.Chunks = append(f.Chunks, &Chunk{Hole: BYTES_PER_MSG})
+	}
+	last := bytes.Repeat([]byte{'A'}, encoded-holes*BYTES_PER_MSG)
+	for i := 0; i < (3-(size-padded)%3)%3; i++ {
+		last[len(last)-1-i] = '='
+	}
+
+	f.Cache = nil
+	f.tail = last
+	f.tailStart = len(f.Chunks)
+	f.flushed = f.tailStart * BYTES_PER_MSG
+	f.Size = size
+	f.Dirty = true
+	return fuse.OK
+}
+
+func (f *FileDesc) appendZeros(n int) fuse.Status {
+	if n <= 0 {
+		return fuse.OK
+	}
+	err := f.appendData(make([]byte, n))
+	if err != nil {
+		log.Println("Failed appending zeros", err)
+		return fuse.EIO
+	}
+	return fuse.OK
+}
+
+// Zeroes the range, the chunks it frees up are released on flush. Sparse files that aren't
+// loaded are punched chunk by chunk, the rest in memory
+func (f *FileDesc) punchHole(off, size uint64) fuse.Status {
+	log.Println("PUNCH HOLE", off, size)
+	if f.IsDir {
+		return fuse.Status(syscall.EISDIR)
+	}
+	if off >= uint64(f.Size) || size == 0 {
+		return fuse.OK
+	}
+	end := off + size
+	if end > uint64(f.Size) {
+		end = uint64(f.Size)
+	}
+
+	if f.Cache == nil && !f.Dirty && f.sparse() {
+		err := f.punchChunks(int64(off), int64(end))
+		if err != nil {
+			log.Println("Failed punching hole", err)
+			return fuse.EIO
+		}
+		f.touch(time.Now())
+		return fuse.OK
+	}
+
+	data, err := f.GetData()
+	if err != nil {
+		log.Println("Failed loading data", err)
+		return fuse.EIO
+	}
+	zeroEncoded(data, 0, int64(off), int64(end))
+	f.Dirty = true
+	if first := int(off * 8 / 6); first < f.flushed {
+		f.flushed = first
+	}
+	f.touch(time.Now())
+	return fuse.OK
+}
+
+// Zeroes the bits of the bytes in [off, end) in encoded, which holds the characters from start
+// on. Every character is 6 bits, so only the characters the range is in change
+func zeroEncoded(encoded []byte, start int, off, end int64) {
+	first, last := int(off*8/6)-start, int((end*8+5)/6)-start
+	if first < 0 {
+		first = 0
+	}
+	if last > len(encoded) {
+		last = len(encoded)
+	}
+	for i := first; i < last; i++ {
+		if encoded[i] == '=' {
+			continue
+		}
+		v := strings.IndexByte(base64Chars, encoded[i])
+		bit := int64(start+i) * 6
+		for k := int64(0); k < 6; k++ {
+			if bit+k >= off*8 && bit+k < end*8 {
+				v &^= 1 << uint(5-k)
+			}
+		}
+		encoded[i] = base64Chars[v]
+	}
+}
+
+// Punches a hole in a file that isn't loaded. Chunks the range covers become holes without
+// being fetched, the ones at its ends (and the last one, which has the padding) are fetched,
+// zeroed and sent again. The old chunks are released once the inode is written
+func (f *FileDesc) punchChunks(off, end int64) error {
+	total := fileDataEncoder.EncodedLen(f.Size)
+	padding := (3 - f.Size%3) % 3
+	// Characters with all their bits in the range are all A, other than the padding
+	whole, wholeEnd := int((off*8+5)/6), int(end*8/6)
+	if wholeEnd > total-padding {
+		wholeEnd = total - padding
+	}
+
+	pos := 0
+	for i, chunk := range f.Chunks {
+		n := chunkLen(chunk)
+		if pos+n > total {
+			n = total - pos
+		}
+		start := pos
+		pos += n
+		if chunk.Hole > 0 || int64(pos)*6 <= off*8 || int64(start)*6 >= end*8 {
+			continue
+		}
+
+		if start >= whole && pos <= wholeEnd {
+			f.garbage = append(f.garbage, chunk)
+			f.Chunks[i] = &Chunk{Hole: n}
+			continue
+		}
+
+		content, err := f.FS.readChunk(f.DataChannelID, chunk)
+		if err != nil {
+			return err
+		}
+		part := append([]byte(nil), content...)
+		zeroEncoded(part, start, off, end)
+		if chunk.Len > 0 && !isZeroPart(part) {
+			packed, err := f.FS.packPart(f.InodeNumber(), part)
+			if err != nil {
+				return err
+			}
+			f.garbage = append(f.garbage, chunk)
+			f.Chunks[i] = packed
+			continue
+		}
+		written, dropped, err := f.FS.writeDedup(f.DataChannelID, [][]byte{part}, []*Chunk{chunk})
+		if err != nil {
+			return err
+		}
+		f.garbage = append(f.garbage, dropped...)
+		f.Chunks[i] = written[0]
+	}
+
+	// The end is fetched again by the next append
+	f.tail = nil
+	f.registerChunks()
+	f.InodeDirty = true
+	return nil
+}
+
+type hole struct {
+	start, end int64
+}
+
+// The holes of the file as stored, in order. Only files with fixed chunks have them at known
+// offsets, content defined chunks are all reported as data
+func (f *FileDesc) holes() []hole {
+	if f.CDC || f.Dirty || f.Inline {
+		return nil
+	}
+
+	holes := make([]hole, 0)
+	pos := 0 // In the encoded data
+	for _, chunk := range f.Chunks {
+		n := chunkLen(chunk)
+		if chunk.Hole > 0 {
+			// Only the bytes with all their bits in the hole, 4 characters make up 3 bytes
+			start, end := int64((pos*6+7)/8), int64((pos+n)*6/8)
+			if last := len(holes) - 1; last >= 0 && holes[last].end >= start-1 {
+				// The byte between two holes is zero too
+				holes[last].end = end
+			} else if end > start {
+				holes = append(holes, hole{start, end})
+			}
+		}
+		pos += n
+	}
+
+	for i := range holes {
+		if holes[i].end > int64(f.Size) {
+			holes[i].end = int64(f.Size)
+		}
+	}
+	return holes
+}
+
+// Finds the next data or hole at or after off for SEEK_DATA and SEEK_HOLE. The end of the file
+// counts as a hole, ENXIO past it or when there's no data left
+func (f *FileDesc) seek(off int64, whence int) (int64, fuse.Status) {
+	if off < 0 || off >= int64(f.Size) {
+		return 0, fuse.Status(syscall.ENXIO)
+	}
+
+	for _, h := range f.holes() {
+		if h.end <= off {
+			continue
+		}
+		if whence == seekHole {
+			if h.start > off {
+				return h.start, fuse.OK
+			}
+			return off, fuse.OK
+		}
+		if h.start > off {
+			return off, fuse.OK
+		}
+		off = h.end
+	}
+
+	if whence == seekHole {
+		return int64(f.Size), fuse.OK
+	}
+	if off >= int64(f.Size) {
+		return 0, fuse.Status(syscall.ENXIO)
+	}
+	return off, fuse.OK
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"syscall"
+	"testing"
+)
+
+// Growing a file by truncating it or writing past the end adds holes, a few messages are sent
+// for the ends whatever the size
+func TestGrowAddsHoles(t *testing.T) {
+	_, root, api := newTestFS(t)
+	ctx := context.Background()
+	file := writeFile(t, root, "image", []byte("header"))
+	sent := api.callCount("send") + api.callCount("edit")
+
+	const size = 1 << 20
+	in := &fuse.SetAttrIn{SetAttrInCommon: fuse.SetAttrInCommon{Valid: fuse.FATTR_SIZE, Size: size}}
+	if code := file.Setattr(ctx, nil, in, &fuse.AttrOut{}); code != 0 {
+		t.Fatal("truncate", code)
+	}
+
+	fh, _, code := file.Open(ctx, syscall.O_WRONLY)
+	if code != 0 {
+		t.Fatal("open", code)
+	}
+	h := fh.(*FileHandle)
+	if _, code = h.Write(ctx, []byte("trailer"), 2*size); code != 0 {
+		t.Fatal("write", code)
+	}
+	if code = h.Flush(ctx); code != 0 {
+		t.Fatal("flush", code)
+	}
+	h.Release(ctx)
+
+	if requests := api.callCount("send") + api.callCount("edit") - sent; requests > 20 {
+		t.Errorf("growing to %d bytes made %d requests", 2*size, requests)
+	}
+
+	want := make([]byte, 2*size+len("trailer"))
+	copy(want, "header")
+	copy(want[2*size:], "trailer")
+	read, code := readFile(file)
+	if code != 0 || !bytes.Equal(read, want) {
+		t.Fatal("read", code, len(read), "bytes, want", len(want))
+	}
+
+	fh, _, _ = file.Open(ctx, syscall.O_RDONLY)
+	h = fh.(*FileHandle)
+	defer h.Release(ctx)
+	hole, code := h.Lseek(ctx, 0, seekHole)
+	if code != 0 || hole == 0 || hole > holeAlign {
+		t.Error("first hole at", hole, code)
+	}
+	data, code := h.Lseek(ctx, hole, seekData)
+	if code != 0 || data <= size || data > 2*size {
+		t.Error("data after the hole at", data, code)
+	}
+}
+
+// Reading a sparse file fetches only the chunks the read is in, holes aren't fetched at all
+func TestSparseReadsOnlyTheRange(t *testing.T) {
+	_, root, api := newTestFS(t)
+	ctx := context.Background()
+	file := writeFile(t, root, "image", []byte("header"))
+	const size = 1 << 20
+	in := &fuse.SetAttrIn{SetAttrInCommon: fuse.SetAttrInCommon{Valid: fuse.FATTR_SIZE, Size: size - 7}}
+	if code := file.Setattr(ctx, nil, in, &fuse.AttrOut{}); code != 0 {
+		t.Fatal("truncate", code)
+	}
+	fh, _, code := file.Open(ctx, syscall.O_RDWR)
+	if code != 0 {
+		t.Fatal("open", code)
+	}
+	h := fh.(*FileHandle)
+	defer h.Release(ctx)
+	if _, code = h.Write(ctx, []byte("trailer"), size-7); code != 0 {
+		t.Fatal("write", code)
+	}
+	if code = h.Flush(ctx); code != 0 {
+		t.Fatal("flush", code)
+	}
+
+	fetches := api.callCount("message") + api.callCount("messages")
+	for _, read := range []struct {
+		off  int64
+		want []byte
+	}{
+		{size / 2, make([]byte, 1<<16)},
+		{size - 7, []byte("trailer")},
+		{0, []byte("header")},
+	} {
+		dest := make([]byte, len(read.want))
+		result, code := h.Read(ctx, dest, read.off)
+		if code != 0 {
+			t.Fatal("read at", read.off, code)
+		}
+		if got, _ := result.Bytes(nil); !bytes.Equal(got, read.want) {
+			t.Errorf("read %d bytes at %d, want %q", len(got), read.off, read.want[:8])
+		}
+	}
+	if n := api.callCount("message") + api.callCount("messages") - fetches; n > 3 {
+		t.Error("reads made", n, "fetches")
+	}
+	if file.desc.Cache != nil {
+		t.Error("file was loaded whole")
+	}
+}
+
+// Punching a hole in a sparse file turns the chunks it covers into holes without fetching them,
+// the chunks at its ends are zeroed where the range covers them
+func TestPunchHoleByChunk(t *testing.T) {
+	fs, root, api := newTestFS(t)
+	ctx := context.Background()
+	data := make([]byte, 3*holeAlign)
+	for i := range data {
+		data[i] = byte(i%251 + 1)
+	}
+	file := writeFile(t, root, "image", data)
+	size := 13 * holeAlign
+	in := &fuse.SetAttrIn{SetAttrInCommon: fuse.SetAttrInCommon{Valid: fuse.FATTR_SIZE, Size: uint64(size)}}
+	if code := file.Setattr(ctx, nil, in, &fuse.AttrOut{}); code != 0 {
+		t.Fatal("truncate", code)
+	}
+
+	fh, _, code := file.Open(ctx, syscall.O_RDWR)
+	if code != 0 {
+		t.Fatal("open", code)
+	}
+	h := fh.(*FileHandle)
+	defer h.Release(ctx)
+	want := append(data, make([]byte, size-len(data))...)
+	requests := api.callCount("message") + api.callCount("messages") + api.callCount("send") + api.callCount("edit")
+	for _, punch := range [][2]int{{1000, 10000}, {15000, 20000}} {
+		if code := h.Allocate(ctx, uint64(punch[0]), uint64(punch[1]-punch[0]), fallocKeepSize|fallocPunchHole); code != 0 {
+			t.Fatal("punch", punch, code)
+		}
+		for i := punch[0]; i < punch[1]; i++ {
+			want[i] = 0
+		}
+	}
+	if code = h.Flush(ctx); code != 0 {
+		t.Fatal("flush", code)
+	}
+	if n := api.callCount("message") + api.callCount("messages") + api.callCount("send") + api.callCount("edit") - requests; n > 10 {
+		t.Error("punching made", n, "requests")
+	}
+	if file.desc.Cache != nil {
+		t.Error("file was loaded whole")
+	}
+	for i := 1; i <= 5; i++ {
+		if file.desc.Chunks[i].Hole == 0 {
+			t.Error("chunk", i, "isn't a hole")
+		}
+	}
+
+	read, code := readFile(file)
+	if code != 0 || !bytes.Equal(read, want) {
+		t.Error("read", code, len(read), "bytes, want", len(want))
+	}
+	stored, err := fs.loadInode(file.ino)
+	if err != nil {
+		t.Fatal("loading inode", err)
+	}
+	decoded, err := stored.decodedData()
+	if err != nil || !bytes.Equal(decoded, want) {
+		t.Error("stored data differs", err)
+	}
+}
+
+// Runs of the same hole are stored as one with a count, and come back as they were
+func TestChunkListRepeat(t *testing.T) {
+	chunks := chunkList{{ID: "1", Edited: "e"}}
+	for i := 0; i < 5; i++ {
+		chunks = append(chunks, &Chunk{Hole: BYTES_PER_MSG})
+	}
+	chunks = append(chunks, &Chunk{ID: "2", Hash: "h"}, &Chunk{Hole: BYTES_PER_MSG}, &Chunk{Hole: 100}, &Chunk{ID: "3", Off: 10, Len: 20})
+
+	encoded, err := json.Marshal(chunks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stored []*Chunk
+	if err := json.Unmarshal(encoded, &stored); err != nil {
+		t.Fatal(err)
+	}
+	if len(stored) != 6 || stored[1].Repeat != 4 {
+		t.Errorf("stored as %s", encoded)
+	}
+
+	var decoded chunkList
+	if err := json.Unmarshal(encoded, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded) != len(chunks) {
+		t.Fatalf("got %d chunks back, want %d", len(decoded), len(chunks))
+	}
+	for i := range chunks {
+		if *decoded[i] != *chunks[i] {
+			t.Errorf("chunk %d is %+v, want %+v", i, *decoded[i], *chunks[i])
+		}
+	}
+}
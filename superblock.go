@@ -0,0 +1,436 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"log"
+	"syscall"
+	"time"
+)
+
+// The superblock lives in the root inode. It identifies the filesystem and keeps count of what's
+// stored, so statfs doesn't have to walk the tree. The counts are kept in memory and written
+// every superblockInterval along with the chunk index and the free list. Since a crash loses the changes since,
+// mounting marks the superblock unclean until it's unmounted and everything is counted again
+// after a crash
+
+const superblockInterval = 30 * time.Second
+
+// Every mount keeps its own counts and chunk index in memory, two mounts writing the same superblock
+// would undo each other. A mount holds a lease in the superblock, renewed as it's written, and
+// others refuse to mount until it's given up on unmount or runs out. A mount forced past the lease
+// counts everything again, the mount it took the lease from stops writing the superblock once it
+// notices
+const leaseTime = 5 * time.Minute
+
+// How long to wait after taking the lease before checking nobody took it at the same time
+var leaseSettle = 5 * time.Second
+
+var ErrMounted = errors.New("Filesystem is mounted elsewhere")
+
+type Superblock struct {
+	UUID     string `json:"uuid"`
+	Files    int64  `json:"files"`    // Inodes, including directories and the root
+	Bytes    int64  `json:"bytes"`    // Size of all files
+	Messages int64  `json:"messages"` // Messages sent to the channel, everything we store is a message
+
+	Index []*Chunk `json:"index,omitempty"` // Messages holding the chunk index
+	Free  []*Chunk `json:"free,omitempty"`  // Messages holding the free list
+	Clean bool     `json:"clean,omitempty"` // Unmounted since the counts were last written
+
+	Mount string `json:"mount,omitempty"` // Id of the mount holding the lease, empty once unmounted
+	Lease int64  `json:"lease,omitempty"` // When the lease runs out, in unix nanoseconds
+}
+
+func newUUID() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	// Version 4, random
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
+
+// Takes the lease for this mount and writes it to the root inode, fails with ErrMounted while
+// another mount holds it unless forced
+func (fs *DiscordFS) takeLease(root *FileDesc) error {
+	if root.Super == nil {
+		// Counted when the superblock is loaded
+		root.Super = &Superblock{}
+	}
+	held := root.Super
+	if held.Mount != "" && held.Lease > time.Now().UnixNano() {
+		if !*flagForce {
+			log.Println("Mount", held.Mount, "holds the lease until", time.Unix(0, held.Lease).Format(time.Stamp)+", -force mounts anyway")
+			return ErrMounted
+		}
+		log.Println("Taking the lease from mount", held.Mount)
+		held.Clean = false
+	}
+
+	id, err := newUUID()
+	if err != nil {
+		return err
+	}
+	fs.mount = id
+	held.Mount = id
+	held.Lease = time.Now().Add(leaseTime).UnixNano()
+	err = root.WriteInode()
+	if err != nil {
+		return err
+	}
+
+	// Another mount may have read the superblock before it was written and written its own lease
+	time.Sleep(leaseSettle)
+	stored, err := fs.loadInode(root.InodeNumber())
+	if err != nil {
+		return err
+	}
+	if stored.Super == nil || stored.Super.Mount != id {
+		return ErrMounted
+	}
+	return nil
+}
+
+// Sets up the usage counters and the chunk index from the superblock in the root inode,
+// counting everything if it wasn't unmounted cleanly or was made before the superblock
+func (fs *DiscordFS) loadSuperblock(root *FileDesc) error {
+	usage := root.Super
+	if usage == nil || !usage.Clean || *flagRecount {
+		log.Println("Counting usage, chunk references and quotas, this fetches every inode")
+		counted, refs, quotas, err := fs.countUsage(root)
+		if err != nil {
+			return err
+		}
+		fs.setQuotas(quotas)
+		if usage != nil {
+			counted.UUID = usage.UUID
+			counted.Index = usage.Index
+			counted.Free = usage.Free
+			counted.Mount = usage.Mount
+			counted.Lease = usage.Lease
+		}
+		usage = counted
+		fs.setIndex(refs)
+		fs.indexDirty = true
+	} else {
+		refs, err := fs.loadIndex(usage.Index)
+		if err != nil {
+			return err
+		}
+		fs.setIndex(refs)
+	}
+	if root.Super != nil {
+		fs.restoreFreeList(root.Super)
+	}
+	usage.Clean = false
+	if usage.Mount != "" {
+		// Counting may have taken a while
+		usage.Lease = time.Now().Add(leaseTime).UnixNano()
+	}
+
+	if usage.UUID == "" {
+		var err error
+		usage.UUID, err = newUUID()
+		if err != nil {
+			return err
+		}
+	}
+
+	fs.usageLock.Lock()
+	fs.usage = usage
+	fs.usageLock.Unlock()
+	log.Printf("Filesystem %s: %d files, %d bytes in %d messages\n", usage.UUID, usage.Files, usage.Bytes, usage.Messages)
+	return root.WriteInode()
+}
+
+// Walks the tree and adds up what every inode takes, along with the references to the
+// messages in the chunk index and the usage of the quotas below root, by inode number
+func (fs *DiscordFS) countUsage(root *FileDesc) (*Superblock, map[string]*indexEntry, map[uint64]*Quota, error) {
+	usage := &Superblock{Messages: 1} // The journal
+	seen := make(map[uint64]bool)
+	shared := make(map[string]bool)
+	refs := make(map[string]*indexEntry)
+	quotas := make(map[uint64]*Quota)
+
+	// above are the quotas the inode is charged to
+	var walk func(desc *FileDesc, above []*Quota) error
+	walk = func(desc *FileDesc, above []*Quota) error {
+		if seen[desc.InodeNumber()] {
+			// Another link, which can't be in another quota
+			return nil
+		}
+		seen[desc.InodeNumber()] = true
+
+		if desc.IsDir && desc.Quota != nil {
+			q := &Quota{MaxBytes: desc.Quota.MaxBytes, MaxFiles: desc.Quota.MaxFiles}
+			quotas[desc.InodeNumber()] = q
+			above = append(above[:len(above):len(above)], q)
+		}
+		for _, q := range above {
+			q.Files++
+			q.Bytes += int64(desc.Size)
+		}
+
+		usage.Files++
+		usage.Bytes += int64(desc.Size)
+		usage.Messages += int64(desc.messageCount())
+		for _, chunk := range desc.Chunks {
+			if chunk.Len > 0 {
+				shared[chunk.ID] = true
+			} else if chunk.Hash != "" {
+				shared[chunk.ID] = true
+				entry, ok := refs[chunk.ID]
+				if !ok {
+					entry = &indexEntry{Hash: chunk.Hash, ID: chunk.ID, Edited: chunk.Edited}
+					refs[chunk.ID] = entry
+				}
+				entry.Refs++
+			}
+		}
+		if !desc.IsDir {
+			return nil
+		}
+
+		entries, err := desc.GetDirEntries()
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			child := entry.legacy
+			if child == nil {
+				child, err = fs.loadInode(entry.Ino)
+				if err != nil {
+					return err
+				}
+			}
+			err = walk(child, above)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	err := walk(root, nil)
+	usage.Messages += int64(len(shared))
+	return usage, refs, quotas, err
+}
+
+// Reads JSON stored across messages listed in the superblock, like the chunk index, into v.
+// Nothing is read if there are no messages
+func (fs *DiscordFS) loadListed(chunks []*Chunk, v interface{}) error {
+	encoded := make([]byte, 0)
+	for _, chunk := range chunks {
+		content, err := fs.fetchChunk(fs.Guild, chunk)
+		if err != nil {
+			return err
+		}
+		encoded = append(encoded, content...)
+	}
+	if len(encoded) == 0 {
+		return nil
+	}
+	return json.Unmarshal(encoded, v)
+}
+
+// Writes v as JSON to the messages in old, returns the messages now holding it. Those are always
+// sent, never taken from the free list. Nothing is written if v is empty and there were no messages
+func (fs *DiscordFS) saveListed(v interface{}, empty bool, old []*Chunk) ([]*Chunk, error) {
+	if empty && len(old) == 0 {
+		return nil, nil
+	}
+	encoded, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return fs.writeParts(fs.Guild, splitParts(encoded), old)
+}
+
+// A copy of the superblock with the current counts, nil before it's loaded
+func (fs *DiscordFS) superblock() *Superblock {
+	fs.usageLock.Lock()
+	defer fs.usageLock.Unlock()
+	if fs.usage == nil {
+		return nil
+	}
+	usage := *fs.usage
+	return &usage
+}
+
+func (fs *DiscordFS) addUsage(files, bytes, messages int64) {
+	fs.usageLock.Lock()
+	defer fs.usageLock.Unlock()
+	if fs.usage == nil {
+		// Still counting, whatever changes now is counted by the walk
+		return
+	}
+	fs.usage.Files += files
+	fs.usage.Bytes += bytes
+	fs.usage.Messages += messages
+	fs.usageDirty = true
+}
+
+// Writes the counts and the chunk index to the superblock and the quotas now and then
+func (fs *DiscordFS) saveUsage(root *Node) {
+	for range time.Tick(superblockInterval) {
+		fs.writeUsage(root)
+	}
+}
+
+func (fs *DiscordFS) writeUsage(root *Node) {
+	if !fs.renewLease(root) {
+		return
+	}
+
+	fs.indexLock.Lock()
+	indexDirty := fs.indexDirty
+	fs.indexLock.Unlock()
+	if indexDirty {
+		old := fs.superblock().Index
+		chunks, err := fs.saveIndex(old)
+		if err != nil {
+			log.Println("Failed writing chunk index", err)
+		} else {
+			fs.usageLock.Lock()
+			fs.usage.Index = chunks
+			fs.usageDirty = true
+			fs.usageLock.Unlock()
+		}
+	}
+
+	fs.freeLock.Lock()
+	freeDirty := fs.freeDirty
+	fs.freeLock.Unlock()
+	if freeDirty {
+		old := fs.superblock().Free
+		chunks, err := fs.saveFreeList(old)
+		if err != nil {
+			log.Println("Failed writing free list", err)
+		} else {
+			fs.usageLock.Lock()
+			fs.usage.Free = chunks
+			fs.usageDirty = true
+			fs.usageLock.Unlock()
+		}
+	}
+
+	fs.usageLock.Lock()
+	dirty, quotas := fs.usageDirty, fs.quotaDirty
+	fs.usageDirty = false
+	fs.quotaDirty = make(map[uint64]bool)
+	fs.usageLock.Unlock()
+
+	if dirty {
+		// WriteInode picks up the counts
+		root.lock.Lock()
+		root.desc.InodeDirty = true
+		root.syncInodeLocked()
+		root.lock.Unlock()
+	}
+	for ino := range quotas {
+		if !dirty || ino != root.ino {
+			fs.writeQuota(ino)
+		}
+	}
+}
+
+// Extends the lease once half of it is left, false if another mount took it and the superblock
+// isn't ours to write anymore
+func (fs *DiscordFS) renewLease(root *Node) bool {
+	fs.usageLock.Lock()
+	lost, mount, lease := fs.leaseLost, fs.usage.Mount, fs.usage.Lease
+	fs.usageLock.Unlock()
+	if lost {
+		return false
+	}
+	if mount == "" || time.Until(time.Unix(0, lease)) > leaseTime/2 {
+		return true
+	}
+
+	stored, err := fs.loadInode(root.ino)
+	if err != nil {
+		log.Println("Failed checking the lease, renewing it anyway", err)
+	} else if stored.Super != nil && stored.Super.Mount != mount {
+		log.Println("Mount", stored.Super.Mount, "took the lease, not writing the superblock anymore")
+		fs.usageLock.Lock()
+		fs.leaseLost = true
+		fs.usageLock.Unlock()
+		fs.dropFreeList()
+		return false
+	}
+
+	fs.usageLock.Lock()
+	fs.usage.Lease = time.Now().Add(leaseTime).UnixNano()
+	fs.usageDirty = true
+	fs.usageLock.Unlock()
+	return true
+}
+
+// Writes everything and marks the superblock clean, so the next mount can trust the counts
+func (fs *DiscordFS) unmounted(root *Node) {
+	log.Println("Unmounted, writing superblock")
+	fs.writeUsage(root)
+
+	fs.usageLock.Lock()
+	lost := fs.leaseLost
+	fs.usage.Clean = true
+	fs.usage.Mount = ""
+	fs.usage.Lease = 0
+	fs.usageLock.Unlock()
+	if lost {
+		return
+	}
+
+	root.lock.Lock()
+	defer root.lock.Unlock()
+	root.desc.InodeDirty = true
+	if code := root.syncInodeLocked(); code != fuse.OK {
+		log.Println("Failed marking superblock clean")
+	}
+}
+
+// How many messages the inode takes up, including its handle but not the packs it's in
+func (f *FileDesc) messageCount() int {
+	data := len(ownChunkIDs(f.Chunks))
+	if f.Chunks == nil {
+		data = f.capacity()
+	}
+	return 1 + len(f.records) + data + len(f.xattrMessages())
+}
+
+// Blocks are messages, so df shows what's stored in them and stat -f how many there are.
+// The kernel doesn't pass a filesystem id on from fuse, the uuid is in the mount source instead
+func (n *Node) Statfs(ctx context.Context, out *fuse.StatfsOut) syscall.Errno {
+	usage := n.fs.superblock()
+	if usage == nil {
+		return syscall.EIO
+	}
+
+	blocks := uint64(*flagCapacity) * 1000000 / BYTES_PER_MSG
+	used := uint64(usage.Messages)
+	free := uint64(0)
+	if used < blocks {
+		free = blocks - used
+	}
+
+	*out = fuse.StatfsOut{
+		Blocks: blocks,
+		Bfree:  free,
+		Bavail: free,
+		// There's no inode limit, but every inode needs a message
+		Files:   uint64(usage.Files) + free,
+		Ffree:   free,
+		Bsize:   BYTES_PER_MSG,
+		Frsize:  BYTES_PER_MSG,
+		NameLen: 255,
+	}
+	return 0
+}
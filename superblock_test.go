@@ -0,0 +1,85 @@
+package main
+
+import (
+	"github.com/jonas747/discordgo"
+	"testing"
+)
+
+// A second mount is refused while the first holds the lease. Forced, it takes the lease and
+// the first stops writing the superblock and using its free list
+func TestLeaseKeepsOneMount(t *testing.T) {
+	fs, root, api := newTestFS(t)
+
+	mount := func() (*DiscordFS, *FileDesc, error) {
+		other := NewFS(&discordgo.Session{}, testGuild, nil)
+		other.api = api
+		desc, err := other.loadInode(root.ino)
+		if err != nil {
+			t.Fatal("loading root", err)
+		}
+		return other, desc, other.takeLease(desc)
+	}
+
+	if _, _, err := mount(); err != ErrMounted {
+		t.Fatal("second mount got", err, "want", ErrMounted)
+	}
+
+	*flagForce = true
+	defer func() { *flagForce = false }()
+	other, desc, err := mount()
+	if err != nil {
+		t.Fatal("forced mount", err)
+	}
+	if desc.Super.Clean {
+		t.Error("forced mount trusts the counts")
+	}
+	*flagForce = false
+
+	sent, err := api.ChannelMessageSend(testGuild, "freed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs.freeMessages(testGuild, []string{sent.ID})
+	if len(fs.free) != 1 {
+		t.Fatal("free list has", len(fs.free), "messages")
+	}
+
+	// Past half the lease the first mount checks it before writing
+	fs.usageLock.Lock()
+	fs.usage.Lease = 0
+	fs.usageLock.Unlock()
+	fs.writeUsage(root)
+	if !fs.leaseLost {
+		t.Fatal("first mount didn't notice the lease was taken")
+	}
+
+	// Its free list may have messages the other mount reuses, it's dropped and freeing deletes
+	if len(fs.free) != 0 {
+		t.Error("free list kept", len(fs.free), "messages")
+	}
+	spare, err := api.ChannelMessageSend(testGuild, "spare")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs.freeMessages(testGuild, []string{spare.ID})
+	if len(fs.free) != 0 || api.messages[spare.ID] != nil {
+		t.Error("freed message wasn't deleted")
+	}
+	fs.unmounted(root)
+	stored, err := other.loadInode(root.ino)
+	if err != nil {
+		t.Fatal("loading root", err)
+	}
+	if stored.Super.Mount != other.mount {
+		t.Error("first mount wrote over the lease of", other.mount, "with", stored.Super.Mount)
+	}
+
+	// Once given up the next mount gets it
+	if err := other.loadSuperblock(desc); err != nil {
+		t.Fatal("loading superblock", err)
+	}
+	other.unmounted(other.newNode(desc))
+	if _, _, err := mount(); err != nil {
+		t.Error("mount after unmounting got", err)
+	}
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	fusefs "github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"log"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+// Extended attributes. Small values are stored in the inode, larger ones get their own
+// messages (the xattr blob) so the inode stays small
+
+const (
+	XATTR_NAME_MAX   = 255   // Same as the kernel
+	XATTR_SIZE_MAX   = 65536 // Same as the kernel
+	XATTR_INLINE_MAX = 256   // Values larger than this go in the xattr blob
+	XATTR_TOTAL_MAX  = 262144
+
+	// setxattr flags
+	XATTR_CREATE  = 1
+	XATTR_REPLACE = 2
+)
+
+type XattrBlob struct {
+	Size   int      `json:"size"`
+	Chunks []*Chunk `json:"chunks"`
+}
+
+func (f *FileDesc) xattrSize(name string) (int, bool) {
+	if value, ok := f.Xattrs[name]; ok {
+		return len(value), true
+	}
+	if blob, ok := f.XattrBlobs[name]; ok {
+		return blob.Size, true
+	}
+	return 0, false
+}
+
+func (f *FileDesc) xattrTotal() int {
+	total := 0
+	for name, value := range f.Xattrs {
+		total += len(name) + len(value)
+	}
+	for name, blob := range f.XattrBlobs {
+		total += len(name) + blob.Size
+	}
+	return total
+}
+
+func (f *FileDesc) GetXattr(name string) ([]byte, fuse.Status) {
+	if value, ok := f.Xattrs[name]; ok {
+		return value, fuse.OK
+	}
+	blob, ok := f.XattrBlobs[name]
+	if !ok {
+		return nil, fuse.ENODATA
+	}
+
+	encoded := make([]byte, 0)
+	for _, chunk := range blob.Chunks {
+		content, err := f.FS.fetchChunk(f.DataChannelID, chunk)
+		if err != nil {
+			log.Println("Failed getting xattr", name, err)
+			return nil, fuse.EIO
+		}
+		encoded = append(encoded, content...)
+	}
+
+	value := make([]byte, fileDataEncoder.DecodedLen(len(encoded)))
+	n, err := fileDataEncoder.Decode(value, encoded)
+	if err != nil {
+		log.Println("Failed decoding xattr", name, err)
+		return nil, fuse.EIO
+	}
+	return value[:n], fuse.OK
+}
+
+func (f *FileDesc) SetXattr(name string, value []byte, flags int) fuse.Status {
+	if len(name) > XATTR_NAME_MAX {
+		return fuse.ERANGE
+	}
+	if len(value) > XATTR_SIZE_MAX {
+		return fuse.Status(syscall.E2BIG)
+	}
+
+	oldSize, exists := f.xattrSize(name)
+	if exists && flags&XATTR_CREATE != 0 {
+		return fuse.Status(syscall.EEXIST)
+	}
+	if !exists && flags&XATTR_REPLACE != 0 {
+		return fuse.ENODATA
+	}
+	if !exists {
+		oldSize = -len(name)
+	}
+	if f.xattrTotal()-oldSize+len(value) > XATTR_TOTAL_MAX {
+		return fuse.Status(syscall.ENOSPC)
+	}
+
+	var old []*Chunk
+	if blob, ok := f.XattrBlobs[name]; ok {
+		old = blob.Chunks
+	}
+
+	if len(value) <= XATTR_INLINE_MAX {
+		f.garbage = append(f.garbage, old...)
+		delete(f.XattrBlobs, name)
+		if f.Xattrs == nil {
+			f.Xattrs = make(map[string][]byte)
+		}
+		f.Xattrs[name] = value
+	} else {
+		encoded := make([]byte, fileDataEncoder.EncodedLen(len(value)))
+		fileDataEncoder.Encode(encoded, value)
+
+		// Edits the messages of the old value where possible
+		chunks, err := f.FS.writeParts(f.DataChannelID, splitParts(encoded), old)
+		if err != nil {
+			log.Println("Failed writing xattr", name, err)
+			return fuse.EIO
+		}
+
+		delete(f.Xattrs, name)
+		if f.XattrBlobs == nil {
+			f.XattrBlobs = make(map[string]*XattrBlob)
+		}
+		f.XattrBlobs[name] = &XattrBlob{Size: len(value), Chunks: chunks}
+	}
+
+	f.changed()
+	return fuse.OK
+}
+
+func (f *FileDesc) RemoveXattr(name string) fuse.Status {
+	if _, ok := f.Xattrs[name]; ok {
+		delete(f.Xattrs, name)
+	} else if blob, ok := f.XattrBlobs[name]; ok {
+		f.garbage = append(f.garbage, blob.Chunks...)
+		delete(f.XattrBlobs, name)
+	} else {
+		return fuse.ENODATA
+	}
+
+	f.changed()
+	return fuse.OK
+}
+
+func (f *FileDesc) ListXattr() []string {
+	names := make([]string, 0, len(f.Xattrs)+len(f.XattrBlobs))
+	for name := range f.Xattrs {
+		names = append(names, name)
+	}
+	for name := range f.XattrBlobs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// The ids of the messages in the xattr blob
+func (f *FileDesc) xattrMessages() []string {
+	ids := make([]string, 0)
+	for _, blob := range f.XattrBlobs {
+		ids = append(ids, chunkIDs(blob.Chunks)...)
+	}
+	return ids
+}
+
+func chunkIDs(chunks []*Chunk) []string {
+	ids := make([]string, len(chunks))
+	for i, chunk := range chunks {
+		ids[i] = chunk.ID
+	}
+	return ids
+}
+
+// ACLs would need to be enforced by us, so the system namespace isn't supported
+func xattrSupported(name string) bool {
+	return !strings.HasPrefix(name, "system.")
+}
+
+func (n *Node) Getxattr(ctx context.Context, attribute string, dest []byte) (uint32, syscall.Errno) {
+	if isQuotaXattr(attribute) {
+		value, code := n.getQuotaXattr(attribute)
+		if code != fuse.OK {
+			return 0, errno(code)
+		}
+		return copyXattr(dest, value)
+	}
+	if !xattrSupported(attribute) {
+		return 0, syscall.EOPNOTSUPP
+	}
+
+	n.lock.RLock()
+	value, code := n.desc.GetXattr(attribute)
+	n.lock.RUnlock()
+	if code != fuse.OK {
+		return 0, errno(code)
+	}
+	return copyXattr(dest, value)
+}
+
+// Values that don't fit report their size, which is what the kernel asks for with an empty dest
+func copyXattr(dest, value []byte) (uint32, syscall.Errno) {
+	if len(dest) < len(value) {
+		return uint32(len(value)), syscall.ERANGE
+	}
+	return uint32(copy(dest, value)), fusefs.OK
+}
+
+func (n *Node) Setxattr(ctx context.Context, attribute string, data []byte, flags uint32) syscall.Errno {
+	if isQuotaXattr(attribute) {
+		if !n.mayChangeQuota(ctx) {
+			return syscall.EPERM
+		}
+		return errno(n.setQuotaXattr(attribute, data))
+	}
+	if !xattrSupported(attribute) {
+		return syscall.EOPNOTSUPP
+	}
+
+	n.lock.Lock()
+	log.Println("SETXATTR", n.getPath(), attribute, len(data))
+	value := make([]byte, len(data))
+	copy(value, data)
+	code := n.desc.SetXattr(attribute, value, int(flags))
+	n.lock.Unlock()
+	if code != fuse.OK {
+		return errno(code)
+	}
+	return errno(n.syncInode())
+}
+
+func (n *Node) Removexattr(ctx context.Context, attribute string) syscall.Errno {
+	if isQuotaXattr(attribute) {
+		if !n.mayChangeQuota(ctx) {
+			return syscall.EPERM
+		}
+		return errno(n.setQuotaLimit(attribute, 0))
+	}
+
+	n.lock.Lock()
+	log.Println("REMOVEXATTR", n.getPath(), attribute)
+	code := n.desc.RemoveXattr(attribute)
+	n.lock.Unlock()
+	if code != fuse.OK {
+		return errno(code)
+	}
+	return errno(n.syncInode())
+}
+
+// The names, each ending in a zero byte
+func (n *Node) Listxattr(ctx context.Context, dest []byte) (uint32, syscall.Errno) {
+	n.lock.RLock()
+	names := n.desc.ListXattr()
+	n.lock.RUnlock()
+
+	if q := n.fs.quota(n.ino); q != nil {
+		if q.MaxBytes > 0 {
+			names = append(names, quotaXattrBytes)
+		}
+		if q.MaxFiles > 0 {
+			names = append(names, quotaXattrFiles)
+		}
+	}
+
+	list := make([]byte, 0)
+	for _, name := range names {
+		list = append(append(list, name...), 0)
+	}
+	return copyXattr(dest, list)
+}